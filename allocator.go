@@ -1,22 +1,55 @@
 package fastcache
 
 import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
+const (
+	// allocAlign 所有分配都按8字节对齐. shard.seq, processLocker.started等字段用64位原子操作访问,
+	// 没有对齐时可能跨cache line, 32位平台上直接panic. metadata本身的大小也是8的倍数, 第一次分配就是对齐的
+	allocAlign = 8
+	// growAlign 扩容按1MB对齐
+	growAlign = 1 * MB
+)
+
+// growable 可以扩容的内存, 目前只有MMAP
+type growable interface {
+	// grow 扩大底层的文件并且映射, 调用方需要持有全局分配锁
+	grow(size uint64) error
+	// extend 映射其他进程扩容之后新增的部分
+	extend(size uint64) error
+	maxSize() uint64
+}
+
 // allocator 全局的内存分配, 所有的内存分配最终都是通过他分配出去
 type allocator struct {
 	mem      Memory
 	metadata *metadata
 	locker   Locker
+	wal      *wal   // 不为nil时Set/Delete在分片锁内写WAL
+	mapped   uint64 // 当前进程已经映射到的扩容代数
+
+	procTimeout time.Duration // 进程心跳超时, 用来判断锁的持有者是否存活
+
+	// 扩容之后对新增的部分同样prefault和mlock
+	prefaultPages bool
+	lockPages     bool
+	readOnly      bool
 }
 
 func (g *allocator) alloc(size uint64) (ptr unsafe.Pointer, offset uint64, err error) {
 	g.locker.Lock()
 	defer g.locker.Unlock()
+	g.remap()
+	size = (size + allocAlign - 1) &^ (allocAlign - 1)
 	if size > g.freeMemory() {
-		err = ErrNoSpace
-		return
+		if err = g.grow(size); err != nil {
+			return
+		}
 	}
 	offset = g.metadata.Used
 	ptr = g.mem.PtrOffset(offset)
@@ -24,10 +57,104 @@ func (g *allocator) alloc(size uint64) (ptr unsafe.Pointer, offset uint64, err e
 	return
 }
 
+// journal 记录一次成功的修改, 调用方需要持有分片锁
+func (g *allocator) journal(op uint8, key []byte, value []byte) error {
+	if g.wal == nil {
+		return nil
+	}
+	return g.wal.append(op, key, value)
+}
+
+// journalSet 记录一次写入, 带过期时间的写入记录为walSetExpire, value前面加上8字节的过期时间
+func (g *allocator) journalSet(key []byte, value []byte, expireAt int64) error {
+	if expireAt == 0 {
+		return g.journal(walSet, key, value)
+	}
+	if g.wal == nil {
+		return nil
+	}
+	b := binary.LittleEndian.AppendUint64(make([]byte, 0, 8+len(value)), uint64(expireAt))
+	return g.wal.append(walSetExpire, key, append(b, value...))
+}
+
+// grow 剩余内存不够时扩容到原来的两倍, 至少能放下size, 最大不超过Config.MaxMemorySize, 调用方需要持有全局分配锁
+func (g *allocator) grow(size uint64) error {
+	gm, ok := g.mem.(growable)
+	if !ok {
+		return ErrNoSpace
+	}
+	meta := g.metadata
+	need := meta.Used + size
+	newSize := max(meta.TotalSize*2, need)
+	newSize = min((newSize+growAlign-1)&^(growAlign-1), gm.maxSize())
+	if newSize < need {
+		return ErrNoSpace
+	}
+	from := g.mem.Size()
+	if err := gm.grow(newSize); err != nil {
+		return fmt.Errorf("%w: grow to %d: %v", ErrNoSpace, newSize, err)
+	}
+	// 还没有更新TotalSize, 失败时下一次扩容会重试
+	if err := g.prepareGrown(from); err != nil {
+		return err
+	}
+	atomic.StoreUint64(&meta.TotalSize, newSize)
+	atomic.StoreUint64(&g.mapped, atomic.AddUint64(&meta.Generation, 1))
+	return nil
+}
+
+// remap 其他进程扩容之后映射新增的部分, 访问任何共享内存中的偏移量之前都需要调用, 在分片锁和全局分配锁之后调用
+func (g *allocator) remap() {
+	gen := atomic.LoadUint64(&g.metadata.Generation)
+	if gen == atomic.LoadUint64(&g.mapped) {
+		return
+	}
+	gm, ok := g.mem.(growable)
+	if !ok {
+		return
+	}
+	// 先读generation再读TotalSize, 保证至少映射到gen对应的大小
+	from := g.mem.Size()
+	if err := gm.extend(atomic.LoadUint64(&g.metadata.TotalSize)); err != nil {
+		// 不映射的话接下来访问新增部分的偏移量会直接崩溃
+		panic(fmt.Errorf("remap grown memory: %w", err))
+	}
+	// 其他进程已经扩容成功, 这里锁不住新增部分也只能继续使用
+	_ = g.prepareGrown(from)
+	atomic.StoreUint64(&g.mapped, gen)
+}
+
+// prepareGrown 对扩容新映射的[from, Size)按配置prefault和mlock, 和NewCache时对整个内存做的一样
+func (g *allocator) prepareGrown(from uint64) error {
+	if from >= g.mem.Size() {
+		return nil
+	}
+	if g.prefaultPages {
+		prefault(g.mem, from, g.readOnly)
+	}
+	if g.lockPages {
+		if err := mlock(g.mem, from); err != nil {
+			return fmt.Errorf("mlock grown memory: %w", err)
+		}
+	}
+	return nil
+}
+
 func (g *allocator) freeMemory() uint64 {
 	return g.metadata.TotalSize - g.metadata.Used
 }
 
+// inBounds offset开始的size字节是否都在映射的内存范围内
+func (g *allocator) inBounds(offset uint64, size uint64) bool {
+	end := offset + size
+	return offset >= uint64(sizeOfMetadata) && end >= offset && end <= g.mem.Size()
+}
+
+// shards 已经初始化好的分片数组
+func (g *allocator) shards() *shards {
+	return (*shards)(g.mem.PtrOffset(g.metadata.ShardArrOffset))
+}
+
 func (g *allocator) base() uintptr {
 	return uintptr(g.mem.Ptr())
 }
@@ -39,3 +166,7 @@ func (g *allocator) offset() uint64 {
 func (g *allocator) setLocker(locker Locker) {
 	g.locker = locker
 }
+
+func (g *allocator) holderAlive(pid int32, started uint64) bool {
+	return g.metadata.Procs.holderAlive(pid, started, g.procTimeout)
+}
@@ -0,0 +1,65 @@
+package fastcache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// startBackground 启动进程心跳和主进程选举, 只读进程不能修改共享内存, 都不参与. AttachOnly的工具也不参与
+func (c *cache) startBackground(config *Config) {
+	c.stop = make(chan struct{})
+	if c.readOnly || config.AttachOnly {
+		return
+	}
+	c.wg.Add(2)
+	go c.heartbeatLoop(config.HeartbeatInterval, config.ProcessTimeout)
+	go c.leaderLoop(config.LeaderLease)
+	if w := c.allocator.wal; w != nil && w.policy == WALSyncInterval {
+		c.wg.Add(1)
+		go c.walSyncLoop(w)
+	}
+}
+
+// stopBackground 停止所有后台任务并等待退出
+func (c *cache) stopBackground() {
+	close(c.stop)
+	c.wg.Wait()
+}
+
+func (c *cache) heartbeatLoop(interval time.Duration, timeout time.Duration) {
+	defer c.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.heartbeat(timeout)
+		}
+	}
+}
+
+// heartbeat 更新自己的心跳和操作计数, 顺便清理已经退出的进程.
+// 心跳停了太久被其他进程清理掉的话重新注册, 清理时已经减过Refs, 重新注册要加回来
+func (c *cache) heartbeat(timeout time.Duration) {
+	meta := c.allocator.metadata
+	gets, sets, deletes := c.counters.sum()
+	c.procMu.Lock()
+	defer c.procMu.Unlock()
+	if c.slot < 0 {
+		// 已经关闭
+		return
+	}
+	if !meta.Procs.heartbeat(c.slot, c.owner, gets, sets, deletes) {
+		slot, owner, err := meta.Procs.register(c.pid)
+		if err != nil {
+			return
+		}
+		c.slot, c.owner = slot, owner
+		atomic.AddInt32(&meta.Refs, 1)
+	}
+	if pruned := meta.Procs.prune(c.slot, timeout); pruned > 0 {
+		atomic.AddInt32(&meta.Refs, -int32(pruned))
+	}
+}
@@ -0,0 +1,181 @@
+package fastcache
+
+import "sort"
+
+// batch 批量操作按分片分组, 同一个分片的key只加一次锁
+type batch struct {
+	hashes []uint64
+	shards []uint32 // 每个key所在的分片下标
+	order  []int    // 按分片排序之后的key下标
+}
+
+func (c *cache) newBatch(keys [][]byte, op int) *batch {
+	b := &batch{
+		hashes: make([]uint64, len(keys)),
+		shards: make([]uint32, len(keys)),
+		order:  make([]int, len(keys)),
+	}
+	for i, key := range keys {
+		hash := xxHashBytes(key)
+		c.counters.add(hash, op)
+		b.hashes[i] = hash
+		b.shards[i] = uint32(c.shardIndex(hash, key))
+		b.order[i] = i
+	}
+	sort.Slice(b.order, func(i, j int) bool {
+		return b.shards[b.order[i]] < b.shards[b.order[j]]
+	})
+	return b
+}
+
+// each 依次回调每个分片和分片内的key下标
+func (b *batch) each(c *cache, fn func(shr *shard, group []int)) {
+	for start := 0; start < len(b.order); {
+		index := b.shards[b.order[start]]
+		end := start + 1
+		for end < len(b.order) && b.shards[b.order[end]] == index {
+			end++
+		}
+		fn(c.shards.shard(c.allocator, int(index)), b.order[start:end])
+		start = end
+	}
+}
+
+func (c *cache) HasMulti(keys [][]byte) []bool {
+	result := make([]bool, len(keys))
+	if !c.enter() {
+		return result
+	}
+	defer c.exit()
+	b := c.newBatch(keys, opGet)
+	if c.readOnly {
+		for i, key := range keys {
+			_, result[i] = c.hasReadOnly(b.hashes[i], key)
+		}
+		return result
+	}
+	b.each(c, func(shr *shard, group []int) {
+		shr.HasMulti(c.allocator, b.hashes, keys, group, result)
+	})
+	return result
+}
+
+func (c *cache) GetMulti(keys [][]byte) ([][]byte, error) {
+	if !c.enter() {
+		return nil, ErrCacheClosed
+	}
+	defer c.exit()
+	values := make([][]byte, len(keys))
+	b := c.newBatch(keys, opGet)
+	if c.readOnly {
+		for i, key := range keys {
+			values[i], _, _ = c.peekReadOnly(b.hashes[i], key)
+		}
+		return values, nil
+	}
+	b.each(c, func(shr *shard, group []int) {
+		shr.GetMulti(c.allocator, b.hashes, keys, group, values)
+	})
+	return values, nil
+}
+
+func (c *cache) SetMulti(keys [][]byte, values [][]byte) ([]error, error) {
+	if c.readOnly {
+		return nil, ErrReadOnly
+	}
+	if len(keys) != len(values) {
+		return nil, ErrLengthMismatch
+	}
+	if !c.enter() {
+		return nil, ErrCacheClosed
+	}
+	defer c.exit()
+	errs := make([]error, len(keys))
+	b := c.newBatch(keys, opSet)
+	b.each(c, func(shr *shard, group []int) {
+		shr.SetMulti(c.allocator, b.hashes, keys, values, group, errs)
+	})
+	return errs, nil
+}
+
+func (c *cache) DeleteMulti(keys [][]byte) ([]error, error) {
+	if c.readOnly {
+		return nil, ErrReadOnly
+	}
+	if !c.enter() {
+		return nil, ErrCacheClosed
+	}
+	defer c.exit()
+	errs := make([]error, len(keys))
+	b := c.newBatch(keys, opDelete)
+	b.each(c, func(shr *shard, group []int) {
+		shr.DeleteMulti(c.allocator, b.hashes, keys, group, errs)
+	})
+	return errs, nil
+}
+
+func (s *shard) HasMulti(all *allocator, hashes []uint64, keys [][]byte, group []int, result []bool) {
+	s.lock(all)
+	defer s.unlock(all)
+
+	for _, i := range group {
+		_, node := s.lookup(all, hashes[i], keys[i])
+		result[i] = node != nil
+	}
+}
+
+// GetMulti 和Get一样会增加计数并且移动LRU, 不存在的key对应的value为nil
+func (s *shard) GetMulti(all *allocator, hashes []uint64, keys [][]byte, group []int, values [][]byte) {
+	s.lock(all)
+	defer s.unlock(all)
+
+	ls := s.lruStore(all)
+	for _, i := range group {
+		_, node := s.lookup(all, hashes[i], keys[i])
+		if node == nil {
+			continue
+		}
+		node.count++
+		el := nodeTo[hashmapBucketElement](node)
+		values[i] = el.value()
+		s.markDirty(undoMove, hashes[i])
+		ls.moveToFront(all, node.freeIndex, el.lruNode())
+		s.clearDirty()
+	}
+}
+
+// SetMulti 每个key单独标记修改, 中途退出时最多丢弃正在写入的一个key, 只读进程也不需要等整个分组写完
+func (s *shard) SetMulti(all *allocator, hashes []uint64, keys [][]byte, values [][]byte, group []int, errs []error) {
+	s.lock(all)
+	defer s.unlock(all)
+
+	for _, i := range group {
+		s.beginWrite()
+		s.markDirty(undoSet, hashes[i])
+		_, err := s.set(all, hashes[i], keys[i], values[i])
+		if err == nil {
+			err = all.journal(walSet, keys[i], values[i])
+		}
+		s.clearDirty()
+		s.endWrite()
+		errs[i] = err
+	}
+}
+
+func (s *shard) DeleteMulti(all *allocator, hashes []uint64, keys [][]byte, group []int, errs []error) {
+	s.lock(all)
+	defer s.unlock(all)
+
+	for _, i := range group {
+		prev, node := s.lookup(all, hashes[i], keys[i])
+		s.beginWrite()
+		s.markDirty(undoDelete, hashes[i])
+		err := s.del(all, hashes[i], prev, node)
+		if err == nil {
+			err = all.journal(walDelete, keys[i], nil)
+		}
+		s.clearDirty()
+		s.endWrite()
+		errs[i] = err
+	}
+}
@@ -126,6 +126,43 @@ func newFastCache() fastcache.StringKeyCache {
 	return cache.(fastcache.StringKeyCache)
 }
 
+// benchmarkColdSet 只计时新建cache之后的第一次写入: 每个key在一个cache中只写一次, 写完所有key之后换一个新的cache,
+// 新建和关闭cache不计时. 第一次写入新分配的区域会缺页, Prefault在NewCache时提前完成
+func benchmarkColdSet(b *testing.B, config *fastcache.Config) {
+	config.Shards = sharding
+	config.MaxElementLen = 2 * benchcount
+	b.ReportAllocs()
+	b.ResetTimer()
+	for done := 0; done < b.N; {
+		b.StopTimer()
+		cache, err := fastcache.NewCache(fastcache.GB, config)
+		if err != nil {
+			b.Skip(err)
+		}
+		mc := cache.(fastcache.StringKeyCache)
+		n := min(b.N-done, len(benchkeys))
+		b.StartTimer()
+		for i := 0; i < n; i++ {
+			_ = mc.SetStringKey(benchkeys[i], benchVals[getValIndex(i)])
+		}
+		b.StopTimer()
+		_ = cache.Close()
+		done += n
+	}
+}
+
+func BenchmarkFastCache_ColdSet(b *testing.B) {
+	benchmarkColdSet(b, &fastcache.Config{})
+}
+
+func BenchmarkFastCache_ColdSetPrefault(b *testing.B) {
+	benchmarkColdSet(b, &fastcache.Config{Prefault: true})
+}
+
+func BenchmarkFastCache_ColdSetPrefaultMlock(b *testing.B) {
+	benchmarkColdSet(b, &fastcache.Config{Prefault: true, Mlock: true})
+}
+
 func BenchmarkFastCache_Set(b *testing.B) {
 	var mc = newFastCache()
 	b.ResetTimer()
@@ -173,6 +210,76 @@ func BenchmarkFastCache_Get(b *testing.B) {
 	})
 }
 
+func BenchmarkFastCache_GetAppend(b *testing.B) {
+	var mc = newFastCache()
+	for i := 0; i < benchcount; i++ {
+		value := benchVals[getValIndex(i)]
+		index := getIndex(i)
+		key := benchkeys[index]
+		mc.SetStringKey(key, value)
+	}
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		var i = 0
+		// 每个goroutine复用自己的dst, 不需要Pool
+		dst := make([]byte, 0, valCount)
+		for pb.Next() {
+			index := getIndex(i)
+			dst, _ = mc.GetStringKeyAppend(dst[:0], benchkeys[index])
+			i++
+		}
+	})
+}
+
+func BenchmarkFastCache_PeekAppend(b *testing.B) {
+	var mc = newFastCache()
+	for i := 0; i < benchcount; i++ {
+		value := benchVals[getValIndex(i)]
+		index := getIndex(i)
+		key := benchkeys[index]
+		mc.SetStringKey(key, value)
+	}
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		var i = 0
+		dst := make([]byte, 0, valCount)
+		for pb.Next() {
+			index := getIndex(i)
+			dst, _ = mc.PeekStringKeyAppend(dst[:0], benchkeys[index])
+			i++
+		}
+	})
+}
+
+// BenchmarkFastCache_GetMulti 每次读取100个key, 和循环调用Get对比
+func BenchmarkFastCache_GetMulti(b *testing.B) {
+	var mc = newFastCache()
+	for i := 0; i < benchcount; i++ {
+		value := benchVals[getValIndex(i)]
+		index := getIndex(i)
+		key := benchkeys[index]
+		mc.SetStringKey(key, value)
+	}
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		var i = 0
+		keys := make([][]byte, 100)
+		for pb.Next() {
+			for j := range keys {
+				keys[j] = []byte(benchkeys[getIndex(i+j)])
+			}
+			_, _ = mc.GetMulti(keys)
+			i += len(keys)
+		}
+	})
+}
+
 func BenchmarkFastCache_SetAndGet(b *testing.B) {
 	var mc = newFastCache()
 	for i := 0; i < benchcount; i++ {
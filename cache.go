@@ -1,9 +1,11 @@
 package fastcache
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -14,9 +16,10 @@ import (
 	"github.com/leslie-fei/memcore/shm"
 )
 
-const (
-	magic = uint64(925925925)
-)
+const magic = uint64(925925925)
+
+// closeTimeout Close等待正在进行中的操作完成的最长时间, 测试中会改短
+var closeTimeout = 5 * time.Second
 
 type Cache interface {
 	// Has check if the key exists in the cache.
@@ -33,25 +36,136 @@ type Cache interface {
 	// GetWithBuffer write value into buffer, it returns ErrNotFound when key not exists
 	// and LRU move to front
 	GetWithBuffer(key []byte, buffer io.Writer) error
+	// GetAppend appends the value for key to dst and returns the result, it returns dst and ErrNotFound
+	// when key not exists and LRU move to front. Reusing dst makes the read allocation free
+	GetAppend(dst []byte, key []byte) ([]byte, error)
+	// View calls fn with the value of key without copying it, it returns ErrNotFound when key not exists
+	// and LRU move to front. The slice points into the shared segment and is only valid inside fn:
+	// fn must not modify it, keep it or any sub slice after returning, or pass it to another goroutine,
+	// copy it if it is needed later. The shard lock is held while fn runs, so fn should be short
+	// and must not call the cache. In read only mode fn gets a private copy of the value.
+	View(key []byte, fn func(value []byte) error) error
 	// Set key and value
 	Set(key []byte, value []byte) error
+	// Add sets key only if it not exists, it returns ErrKeyExists otherwise.
+	// The check and the write are atomic across all attached processes
+	Add(key []byte, value []byte) error
+	// SetNX is Add which reports whether key was set instead of returning ErrKeyExists
+	SetNX(key []byte, value []byte) (bool, error)
+	// Replace sets key only if it exists, it returns ErrNotFound otherwise
+	Replace(key []byte, value []byte) error
+	// GetWithVersion get value for key with its version and LRU move to front, every write of a key
+	// stamps a new version which is never reused in the same shard
+	GetWithVersion(key []byte) ([]byte, uint64, error)
+	// CompareAndSwap sets key only if its current version equals version and returns the new version,
+	// it returns ErrVersionMismatch when key was written after version was read and ErrNotFound when key not exists
+	CompareAndSwap(key []byte, value []byte, version uint64) (uint64, error)
+	// Update calls fn with the current value of key under the shard lock and applies the returned Op,
+	// which makes read-modify-write atomic across all attached processes. old points into the shared
+	// segment like the slice of View and is only valid inside fn, it is nil when exists is false.
+	// fn must not call the cache and should be short, the returned value may reuse old
+	Update(key []byte, fn func(old []byte, exists bool) ([]byte, Op)) error
+	// Incr adds delta to the counter of key and returns the new value, the counter is created with delta
+	// when key not exists. Counters are stored as 8 byte big endian int64 and updated in place,
+	// it returns ErrNotCounter when the value of key is not 8 bytes
+	Incr(key []byte, delta int64) (int64, error)
+	// Decr subtracts delta from the counter of key like Incr
+	Decr(key []byte, delta int64) (int64, error)
+	// IncrWithTTL is Incr which sets the counter to expire after ttl when it is created,
+	// an existing counter keeps its expiry. Expired counters are removed lazily and count from zero again
+	IncrWithTTL(key []byte, delta int64, ttl time.Duration) (int64, error)
+	// Append appends data to the value of key, key is created with data when it not exists.
+	// The value is modified in place when the entry's size class has room for it, the expiry is kept
+	Append(key []byte, data []byte) error
+	// SetRange overwrites the value of key from offset with data like Append, the value is extended and
+	// the gap is zero filled when offset is beyond its end
+	SetRange(key []byte, offset int, data []byte) error
+	// SetFromReader sets key to the next size bytes of r, which are copied straight into the shared segment
+	// without buffering the value in the Go heap. The old value is kept when r returns an error or less than
+	// size bytes. r is read without holding the shard lock and the new value only becomes visible once it is
+	// complete. size is limited by the largest size class, ErrValueTooLarge is returned for bigger values
+	SetFromReader(key []byte, r io.Reader, size int64) error
+	// GetReader returns a reader of the value of key and LRU move to front, the value is copied in chunks
+	// as the reader is read and each Read only holds the shard lock while copying.
+	// Read returns ErrVersionMismatch when the value is changed or deleted before it is read to the end
+	GetReader(key []byte) (io.ReadCloser, error)
 	// Peek value for key, but it will not move LRU
 	Peek(key []byte) ([]byte, error)
 	// PeekWithBuffer write value into buffer, but it will not move LRU
 	PeekWithBuffer(key []byte, buffer io.Writer) error
+	// PeekAppend appends the value for key to dst like GetAppend, but it will not move LRU
+	PeekAppend(dst []byte, key []byte) ([]byte, error)
 	// Delete value for key
 	Delete(key []byte) error
-	// Close the cache wait for the ongoing operations to complete, and return ErrCloseTimeout if timeout
+	// HasMulti reports whether each key exists, keys in the same shard are checked under one shard lock
+	HasMulti(keys [][]byte) []bool
+	// GetMulti gets the values for keys like Get, values[i] is nil when keys[i] not exists.
+	// Keys in the same shard are read under one shard lock
+	GetMulti(keys [][]byte) ([][]byte, error)
+	// SetMulti sets keys[i] to values[i] and returns the error of each key,
+	// keys in the same shard are written under one shard lock
+	SetMulti(keys [][]byte, values [][]byte) ([]error, error)
+	// DeleteMulti deletes keys and returns the error of each key, ErrNotFound when the key not exists.
+	// Keys in the same shard are deleted under one shard lock
+	DeleteMulti(keys [][]byte) ([]error, error)
+	// Transaction locks the shard of keys and calls fn, which may get, set and delete keys of that shard
+	// through tx. The writes are applied when fn returns nil and discarded when it returns an error. Space for the
+	// writes is reserved before any of them is applied, when that fails, for example with ErrNoSpace, the entries
+	// evicted for it are put back with their versions and the shards are left as they were.
+	// All keys must be in one shard, use Config.HashTags and a common {tag} to place related keys together,
+	// it returns ErrCrossShard otherwise. fn must not call the cache
+	Transaction(keys [][]byte, fn func(tx *Tx) error) error
+	// MultiTransaction is Transaction for keys in different shards, the shards are locked in ascending index
+	// order so concurrent transactions in any process can not deadlock. tx may access every key in those shards.
+	// A process which dies while applying may leave part of the writes applied
+	MultiTransaction(keys [][]byte, fn func(tx *Tx) error) error
+	// Close the cache wait for the ongoing operations to complete, and return ErrCloseTimeout if timeout.
+	// After that the process leaves the attach registry and the memory is detached. On timeout the process
+	// still leaves the registry at once, the memory is detached in the background when the last operation
+	// returns, and no snapshot or final checkpoint is written.
 	Close() error
+	// Processes returns the processes attached to the segment, read only processes are not registered
+	Processes() []ProcessInfo
+	// IsLeader reports whether this process currently holds the maintenance leader lease
+	IsLeader() bool
+	// RegisterMaintenance registers a task which runs every interval on the leader process only,
+	// it fails over to another attached process automatically when the leader dies. Tasks are started when
+	// the leader renews its lease, every LeaderLease/3, so an interval shorter than that runs every LeaderLease/3.
+	// Registering a name again replaces the task. Names starting with "fastcache." are reserved for internal tasks
+	// and return ErrReservedTaskName, a non positive interval or a nil fn returns ErrInvalidMaintenance
+	RegisterMaintenance(name string, interval time.Duration, fn MaintenanceFunc) error
+	// Verify walks every shard and checks the hashmap chains, LRU lists and free lists are consistent,
+	// corrupted shards are reset when repair is true
+	Verify(repair bool) (*VerifyReport, error)
+	// Destroy marks the segment to be removed and closes the cache, the SHM key or MMAP file
+	// is removed when the last attached process closes
+	Destroy() error
+	// Checkpoint flushes a consistent state of a durable MMAP cache to the file and to the
+	// <MemoryKey>.checkpoint copy, it returns ErrNotDurable when Config.Durable is false
+	Checkpoint() error
+	// Snapshot streams all live entries into w with a portable format which does not depend on the memory type
+	// or the segment layout, shards are locked one at a time so the snapshot is not a point in time view.
+	// A read only cache copies each shard optimistically and retries a shard changed during the copy,
+	// its snapshot does not keep the LRU order
+	Snapshot(w io.Writer) error
+	// Restore sets the entries of a snapshot written by Snapshot, it returns ErrSnapshotInvalid when the
+	// snapshot is corrupted, entries before the corrupted one are kept
+	Restore(r io.Reader) error
+	// Migrate copies all live entries into dst, which may use another memory type, size or shard count.
+	// Entries are moved in small batches from the least recently used so dst keeps the LRU order
+	// as far as possible, writes made during the migration should also go to dst
+	Migrate(dst Cache) error
 }
 
 type StringKeyCache interface {
 	Cache
 	GetStringKey(key string) ([]byte, error)
 	GetStringKeyWithBuffer(key string, buffer io.Writer) error
+	GetStringKeyAppend(dst []byte, key string) ([]byte, error)
 	SetStringKey(key string, value []byte) error
 	PeekStringKey(key string) ([]byte, error)
 	PeekStringKeyWithBuffer(key string, buffer io.Writer) error
+	PeekStringKeyAppend(dst []byte, key string) ([]byte, error)
 	DeleteStringKey(key string) error
 }
 
@@ -61,56 +175,204 @@ func NewCache(size int, c *Config) (Cache, error) {
 	}
 
 	config := mergeConfig(size, c)
+	if config.Durable && config.MemoryType != MMAP {
+		return nil, errors.New("durable requires MemoryType MMAP")
+	}
+	if config.WAL && !config.Durable {
+		return nil, errors.New("wal requires durable")
+	}
+	if config.MaxMemorySize > 0 && (config.MemoryType != MMAP || config.MaxMemorySize < uint64(size)) {
+		return nil, errors.New("max memory size requires MemoryType MMAP and not less than size")
+	}
+	if config.SnapshotPath != "" && config.MemoryType != GO {
+		// SHM/MMAP在进程退出后仍然存在, 不需要快照
+		return nil, errors.New("snapshot path requires MemoryType GO")
+	}
 	confHash, err := getConfigHash(size, config)
 	if err != nil {
 		return nil, err
 	}
 
-	var mem Memory
+	mem, err := newMemory(uint64(size), config)
+	if err != nil {
+		return nil, err
+	}
+	if err = mem.Attach(); err != nil {
+		return nil, err
+	}
+	if config.Prefault {
+		prefault(mem, 0, config.ReadOnly)
+	}
+	if config.Mlock {
+		if err = mlock(mem, 0); err != nil {
+			_ = mem.Detach()
+			return nil, fmt.Errorf("mlock: %w", err)
+		}
+	}
+
+	meta := (*metadata)(mem.Ptr())
+	all := &allocator{
+		mem:           mem,
+		metadata:      meta,
+		locker:        &nopLocker{},
+		prefaultPages: config.Prefault,
+		lockPages:     config.Mlock,
+		readOnly:      config.ReadOnly,
+	}
+
+	ca, err := attachCache(all, mem, meta, config, confHash)
+	if err != nil {
+		if config.Mlock {
+			_ = munlock(mem)
+		}
+		_ = mem.Detach()
+		return nil, err
+	}
+	ca.locked = config.Mlock
+	if config.SnapshotPath != "" {
+		var complete bool
+		if complete, err = ca.loadSnapshotFile(config.SnapshotPath, config.RestoreTimeout); err != nil {
+			_ = ca.Close()
+			return nil, err
+		}
+		// 只恢复了一部分时Close不能用不完整的数据覆盖原来的快照
+		if complete {
+			ca.snapshotPath = config.SnapshotPath
+		}
+	}
+	return ca, nil
+}
+
+// newMemory 根据MemoryType创建还没有挂载的内存
+func newMemory(size uint64, config *Config) (Memory, error) {
+	if config.MemoryKey == "" && config.MemoryType != GO && config.MemoryType != MEMFD {
+		return nil, fmt.Errorf("MemoryType: %d MemoryKey is required", config.MemoryType)
+	}
+	switch {
+	case config.MaxMemorySize > 0:
+		return newGrowMemory(config.MemoryKey, size, config.MaxMemorySize, config.ReadOnly)
+	case config.MemoryType == MEMFD:
+		name := config.MemoryKey
+		if name == "" {
+			name = "fastcache"
+		}
+		return newMemfdMemory(name, config.MemoryFd, size, config.ReadOnly)
+	case config.MemoryType == HUGEPAGE:
+		return newHugePageMemory(config.MemoryKey, size, config.ReadOnly)
+	case config.ReadOnly || config.AttachOnly:
+		return newExistingMemory(config.MemoryType, config.MemoryKey, size, config.ReadOnly)
+	}
+
 	switch config.MemoryType {
 	case GO:
-		mem = gom.NewMemory(uint64(size))
+		return gom.NewMemory(size), nil
 	case SHM:
-		if config.MemoryKey == "" {
-			return nil, errors.New("shm MemoryKey is required")
-		}
-		mem = shm.NewMemory(config.MemoryKey, uint64(size), true)
+		return shm.NewMemory(config.MemoryKey, size, true), nil
 	case MMAP:
-		if config.MemoryKey == "" {
-			return nil, errors.New("mmap MemoryKey is required")
-		}
-		mem = mmap.NewMemory(config.MemoryKey, uint64(size))
+		return mmap.NewMemory(config.MemoryKey, size), nil
 	default:
 		return nil, fmt.Errorf("MemoryType: %d not support", config.MemoryType)
 	}
+}
 
-	if err = mem.Attach(); err != nil {
-		return nil, err
+func attachCache(all *allocator, mem Memory, meta *metadata, config *Config, confHash uint64) (*cache, error) {
+	if (config.ReadOnly || config.AttachOnly) && meta.Magic != magic {
+		// 只读进程不能初始化共享内存
+		return nil, ErrSegmentNotInitialized
 	}
 
-	meta := (*metadata)(mem.Ptr())
-	all := &allocator{
-		mem:      mem,
-		metadata: meta,
-		locker:   &nopLocker{},
+	replay := false
+	if config.Durable && !config.ReadOnly && !config.AttachOnly {
+		// 多个进程同时挂载时, 判断是否第一个进程, 恢复checkpoint, 重放WAL和注册必须串行,
+		// 否则两个进程都可能认为自己是第一个进程, 或者在别的进程恢复到一半时开始使用
+		unlock, err := lockFile(config.MemoryKey + attachLockSuffix)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+		// 必须在检查magic之前, 恢复checkpoint会改写整个metadata
+		if replay, err = prepareDurable(all, config, confHash); err != nil {
+			return nil, err
+		}
 	}
 
-	if meta.Magic == magic && confHash != meta.Hash {
-		return nil, errors.New("config changed should remove shared memory and restart")
+	if meta.Magic == magic {
+		// 布局不一致时结构体按指针强转会互相破坏数据, 必须先于config hash检查
+		if err := checkLayout(meta); err != nil {
+			return nil, err
+		}
+		// 只挂载已有内存的进程不会初始化, 分片和大小都从metadata读取, 不需要和创建时的配置一致
+		if !config.ReadOnly && !config.AttachOnly && confHash != meta.Hash {
+			return nil, errors.New("config changed should remove shared memory and restart")
+		}
+		if meta.TotalSize > mem.Size() {
+			return nil, fmt.Errorf("segment size %d exceeds mapped size %d", meta.TotalSize, mem.Size())
+		}
+		if meta.hasFlag(metaFlagDestroyPending) {
+			return nil, ErrSegmentDestroyed
+		}
 	}
 
 	if meta.Magic != magic {
-		if err = allocCache(all, mem, meta, config, confHash); err != nil {
+		if err := allocCache(all, mem, meta, config, confHash); err != nil {
 			return nil, err
 		}
 	}
 
 	// 替换进程锁
 	locker := (*processLocker)(unsafe.Pointer(all.base() + uintptr(meta.LockerOffset)))
-	all.setLocker(locker)
+	all.setLocker(&segmentLocker{locker: locker, h: all})
+	all.procTimeout = config.ProcessTimeout
+	all.mapped = atomic.LoadUint64(&meta.Generation)
+
+	c := &cache{
+		allocator:  all,
+		shards:     all.shards(),
+		readOnly:   config.ReadOnly,
+		hashTags:   config.HashTags,
+		durable:    config.Durable && !config.AttachOnly,
+		memoryType: config.MemoryType,
+		memoryKey:  config.MemoryKey,
+		pid:        currentPid(),
+		slot:       -1,
+	}
 
-	shrs := (*shards)(unsafe.Pointer(all.base() + uintptr(meta.ShardArrOffset)))
-	return &cache{allocator: all, shards: shrs}, nil
+	if config.WAL && !c.readOnly && !config.AttachOnly {
+		path := config.MemoryKey + walSuffix
+		// 第一个挂载的进程在checkpoint的基础上重放WAL, 重放时不能再写WAL
+		if replay {
+			if err := c.replayWAL(path); err != nil {
+				return nil, err
+			}
+		}
+		w, err := openWAL(path, all, config)
+		if err != nil {
+			return nil, err
+		}
+		all.wal = w
+	}
+
+	// 只读进程不能修改共享内存, 不参与引用计数
+	if !c.readOnly {
+		// 先清理崩溃退出没有来得及注销的进程
+		if pruned := meta.Procs.prune(-1, config.ProcessTimeout); pruned > 0 {
+			atomic.AddInt32(&meta.Refs, -int32(pruned))
+		}
+		slot, owner, err := meta.Procs.register(c.pid)
+		if err != nil {
+			if all.wal != nil {
+				_ = all.wal.close()
+			}
+			return nil, err
+		}
+		c.slot, c.owner = slot, owner
+		atomic.AddInt32(&meta.Refs, 1)
+	}
+	c.startBackground(config)
+	if c.durable && !c.readOnly && !config.AttachOnly && config.CheckpointInterval > 0 {
+		c.scheduleCheckpoint(config.CheckpointInterval)
+	}
+	return c, nil
 }
 
 func allocCache(all *allocator, mem Memory, meta *metadata, config *Config, confHash uint64) (err error) {
@@ -122,9 +384,13 @@ func allocCache(all *allocator, mem Memory, meta *metadata, config *Config, conf
 	}()
 	meta.reset()
 	meta.Magic = magic
+	meta.Layout = layoutFingerprint
 	meta.Hash = confHash
 	meta.TotalSize = mem.Size()
 	meta.Used = uint64(sizeOfMetadata)
+	if config.Durable {
+		meta.setFlag(metaFlagDurable)
+	}
 
 	_, meta.LockerOffset, err = all.alloc(uint64(sizeOfProcessLocker))
 	if err != nil {
@@ -150,121 +416,221 @@ type cache struct {
 	closed    uint32
 	wg        sync.WaitGroup
 	inProcess int32
+	readOnly  bool
+	durable   bool
+	hashTags  bool
+
+	memoryType   MemoryType
+	memoryKey    string
+	snapshotPath string // Close时写入快照的文件, 启动时没有完整恢复快照的话为空
+	locked       bool   // Config.Mlock, detach时解锁, GO内存类型不会munmap
+	pid          int32
+	procMu       sync.Mutex // 保护slot和owner, 心跳发现slot被清理之后会重新注册
+	slot         int        // 在进程注册表中的位置, 只读进程为-1
+	owner        uint64     // 注册时得到的slot owner
+	counters     opCounters
+	stop         chan struct{}
+	maintenance  maintenance
 }
 
 func (c *cache) Has(key []byte) bool {
-	if atomic.LoadUint32(&c.closed) == 1 {
+	if !c.enter() {
 		return false
 	}
-	atomic.AddInt32(&c.inProcess, 1)
-	defer atomic.AddInt32(&c.inProcess, -1)
+	defer c.exit()
 	hash := xxHashBytes(key)
-	shr := c.shard(hash)
+	c.counters.add(hash, opGet)
+	if c.readOnly {
+		_, ok := c.hasReadOnly(hash, key)
+		return ok
+	}
+	shr := c.shard(hash, key)
 	_, ok := shr.Has(c.allocator, hash, key)
 	return ok
 }
 
 func (c *cache) HasWithCounter(key []byte) (uint8, bool) {
-	if atomic.LoadUint32(&c.closed) == 1 {
+	if !c.enter() {
 		return 0, false
 	}
-	atomic.AddInt32(&c.inProcess, 1)
-	defer atomic.AddInt32(&c.inProcess, -1)
+	defer c.exit()
 	hash := xxHashBytes(key)
-	shr := c.shard(hash)
+	c.counters.add(hash, opGet)
+	if c.readOnly {
+		return c.hasReadOnly(hash, key)
+	}
+	shr := c.shard(hash, key)
 	return shr.Has(c.allocator, hash, key)
 }
 
 func (c *cache) GetWithCounter(key []byte) ([]byte, uint8, error) {
-	if atomic.LoadUint32(&c.closed) == 1 {
+	if !c.enter() {
 		return nil, 0, ErrCacheClosed
 	}
-	atomic.AddInt32(&c.inProcess, 1)
-	defer atomic.AddInt32(&c.inProcess, -1)
+	defer c.exit()
 	hash := xxHashBytes(key)
-	shr := c.shard(hash)
+	c.counters.add(hash, opGet)
+	if c.readOnly {
+		return c.peekReadOnly(hash, key)
+	}
+	shr := c.shard(hash, key)
 	return shr.Get(c.allocator, hash, key)
 }
 
 func (c *cache) GetBufferWithCounter(key []byte, buffer io.Writer) (uint8, error) {
-	if atomic.LoadUint32(&c.closed) == 1 {
+	if !c.enter() {
 		return 0, ErrCacheClosed
 	}
-	atomic.AddInt32(&c.inProcess, 1)
-	defer atomic.AddInt32(&c.inProcess, -1)
+	defer c.exit()
 	hash := xxHashBytes(key)
-	shr := c.shard(hash)
+	c.counters.add(hash, opGet)
+	if c.readOnly {
+		value, count, err := c.peekReadOnly(hash, key)
+		if err != nil {
+			return 0, err
+		}
+		_, err = buffer.Write(value)
+		return count, err
+	}
+	shr := c.shard(hash, key)
 	return shr.GetWithBuffer(c.allocator, hash, key, buffer)
 }
 
 func (c *cache) Peek(key []byte) ([]byte, error) {
-	if atomic.LoadUint32(&c.closed) == 1 {
+	if !c.enter() {
 		return nil, ErrCacheClosed
 	}
-	atomic.AddInt32(&c.inProcess, 1)
-	defer atomic.AddInt32(&c.inProcess, -1)
+	defer c.exit()
 	hash := xxHashBytes(key)
-	shr := c.shard(hash)
+	c.counters.add(hash, opGet)
+	if c.readOnly {
+		value, _, err := c.peekReadOnly(hash, key)
+		return value, err
+	}
+	shr := c.shard(hash, key)
 	return shr.Peek(c.allocator, hash, key)
 }
 
 func (c *cache) PeekWithBuffer(key []byte, buffer io.Writer) error {
-	if atomic.LoadUint32(&c.closed) == 1 {
+	if !c.enter() {
 		return ErrCacheClosed
 	}
-	atomic.AddInt32(&c.inProcess, 1)
-	defer atomic.AddInt32(&c.inProcess, -1)
+	defer c.exit()
 	hash := xxHashBytes(key)
-	shr := c.shard(hash)
+	c.counters.add(hash, opGet)
+	if c.readOnly {
+		return c.peekReadOnlyWithBuffer(hash, key, buffer)
+	}
+	shr := c.shard(hash, key)
 	return shr.PeekWithBuffer(c.allocator, hash, key, buffer)
 }
 
 func (c *cache) Delete(key []byte) error {
-	if atomic.LoadUint32(&c.closed) == 1 {
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	if !c.enter() {
 		return ErrCacheClosed
 	}
-	atomic.AddInt32(&c.inProcess, 1)
-	defer atomic.AddInt32(&c.inProcess, -1)
+	defer c.exit()
 	hash := xxHashBytes(key)
-	shr := c.shard(hash)
+	c.counters.add(hash, opDelete)
+	shr := c.shard(hash, key)
 	return shr.Delete(c.allocator, hash, key)
 }
 
 func (c *cache) Set(key []byte, value []byte) error {
-	if atomic.LoadUint32(&c.closed) == 1 {
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	if !c.enter() {
 		return ErrCacheClosed
 	}
-	atomic.AddInt32(&c.inProcess, 1)
-	defer atomic.AddInt32(&c.inProcess, -1)
+	defer c.exit()
 	hash := xxHashBytes(key)
-	shr := c.shard(hash)
+	c.counters.add(hash, opSet)
+	shr := c.shard(hash, key)
 	return shr.Set(c.allocator, hash, key, value)
 }
 
 func (c *cache) Get(key []byte) ([]byte, error) {
-	if atomic.LoadUint32(&c.closed) == 1 {
+	if !c.enter() {
 		return nil, ErrCacheClosed
 	}
-	atomic.AddInt32(&c.inProcess, 1)
-	defer atomic.AddInt32(&c.inProcess, -1)
+	defer c.exit()
 	hash := xxHashBytes(key)
-	shr := c.shard(hash)
+	c.counters.add(hash, opGet)
+	if c.readOnly {
+		v, _, err := c.peekReadOnly(hash, key)
+		return v, err
+	}
+	shr := c.shard(hash, key)
 	v, _, err := shr.Get(c.allocator, hash, key)
 	return v, err
 }
 
 func (c *cache) GetWithBuffer(key []byte, buffer io.Writer) error {
-	if atomic.LoadUint32(&c.closed) == 1 {
+	if !c.enter() {
 		return ErrCacheClosed
 	}
-	atomic.AddInt32(&c.inProcess, 1)
-	defer atomic.AddInt32(&c.inProcess, -1)
+	defer c.exit()
 	hash := xxHashBytes(key)
-	shr := c.shard(hash)
+	c.counters.add(hash, opGet)
+	if c.readOnly {
+		return c.peekReadOnlyWithBuffer(hash, key, buffer)
+	}
+	shr := c.shard(hash, key)
 	_, err := shr.GetWithBuffer(c.allocator, hash, key, buffer)
 	return err
 }
 
+func (c *cache) GetAppend(dst []byte, key []byte) ([]byte, error) {
+	if !c.enter() {
+		return dst, ErrCacheClosed
+	}
+	defer c.exit()
+	hash := xxHashBytes(key)
+	c.counters.add(hash, opGet)
+	if c.readOnly {
+		return c.peekReadOnlyAppend(hash, key, dst)
+	}
+	shr := c.shard(hash, key)
+	return shr.GetAppend(c.allocator, hash, key, dst)
+}
+
+func (c *cache) PeekAppend(dst []byte, key []byte) ([]byte, error) {
+	if !c.enter() {
+		return dst, ErrCacheClosed
+	}
+	defer c.exit()
+	hash := xxHashBytes(key)
+	c.counters.add(hash, opGet)
+	if c.readOnly {
+		return c.peekReadOnlyAppend(hash, key, dst)
+	}
+	shr := c.shard(hash, key)
+	return shr.PeekAppend(c.allocator, hash, key, dst)
+}
+
+func (c *cache) View(key []byte, fn func(value []byte) error) error {
+	if !c.enter() {
+		return ErrCacheClosed
+	}
+	defer c.exit()
+	hash := xxHashBytes(key)
+	c.counters.add(hash, opGet)
+	if c.readOnly {
+		// 乐观读取可能读到写了一半的数据, 只能拷贝之后再交给fn
+		value, _, err := c.peekReadOnly(hash, key)
+		if err != nil {
+			return err
+		}
+		return fn(value)
+	}
+	shr := c.shard(hash, key)
+	return shr.View(c.allocator, hash, key, fn)
+}
+
 func (c *cache) GetStringKey(key string) ([]byte, error) {
 	k := s2b(key)
 	return c.Get(k)
@@ -275,6 +641,11 @@ func (c *cache) GetStringKeyWithBuffer(key string, buffer io.Writer) error {
 	return c.GetWithBuffer(k, buffer)
 }
 
+func (c *cache) GetStringKeyAppend(dst []byte, key string) ([]byte, error) {
+	k := s2b(key)
+	return c.GetAppend(dst, k)
+}
+
 func (c *cache) SetStringKey(key string, value []byte) error {
 	k := s2b(key)
 	return c.Set(k, value)
@@ -290,27 +661,219 @@ func (c *cache) PeekStringKeyWithBuffer(key string, buffer io.Writer) error {
 	return c.PeekWithBuffer(k, buffer)
 }
 
+func (c *cache) PeekStringKeyAppend(dst []byte, key string) ([]byte, error) {
+	k := s2b(key)
+	return c.PeekAppend(dst, k)
+}
+
 func (c *cache) DeleteStringKey(key string) error {
 	k := s2b(key)
 	return c.Delete(k)
 }
 
 func (c *cache) Close() error {
-	if atomic.CompareAndSwapUint32(&c.closed, 0, 1) {
-		time.Sleep(time.Second)
-		retry := 5
+	if !atomic.CompareAndSwapUint32(&c.closed, 0, 1) {
+		return nil
+	}
+	deadline := time.Now().Add(closeTimeout)
+	for atomic.LoadInt32(&c.inProcess) > 0 {
+		if time.Now().After(deadline) {
+			c.closeLater()
+			return ErrCloseTimeout
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.stopBackground()
+	var err error
+	if c.snapshotPath != "" {
+		err = c.saveSnapshotFile(c.snapshotPath)
+	}
+	if c.durable && !c.readOnly && atomic.LoadInt32(&c.allocator.metadata.Refs) == 1 &&
+		!c.allocator.metadata.hasFlag(metaFlagDestroyPending) {
+		// 最后一个进程退出时checkpoint, 下次启动不需要从checkpoint文件恢复
+		err = errors.Join(err, c.checkpoint())
+	}
+	if w := c.allocator.wal; w != nil {
+		err = errors.Join(err, w.close())
+	}
+	return errors.Join(err, c.detach(c.unregister()))
+}
+
+// closeLater Close等待超时之后调用. 还在进行中的操作会继续访问共享内存, 不能马上解除映射,
+// 先离开进程注册表, 其他进程不会再把这个进程算在Refs中, 等最后一个操作结束之后在后台关闭WAL并解除映射.
+// 超时关闭不会保存快照, 也不会在最后一个进程退出时checkpoint
+func (c *cache) closeLater() {
+	// 后台任务可能卡在同一个锁上, 不等它们退出
+	close(c.stop)
+	c.resign()
+	remove := c.unregister()
+	go func() {
+		c.wg.Wait()
 		for atomic.LoadInt32(&c.inProcess) > 0 {
-			if retry <= 0 {
-				return ErrCloseTimeout
+			time.Sleep(time.Millisecond)
+		}
+		if w := c.allocator.wal; w != nil {
+			_ = w.close()
+		}
+		_ = c.detach(remove)
+	}()
+}
+
+func (c *cache) Processes() []ProcessInfo {
+	if !c.enter() {
+		return nil
+	}
+	defer c.exit()
+	return c.allocator.metadata.Procs.list()
+}
+
+func (c *cache) Destroy() error {
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	if atomic.LoadUint32(&c.closed) == 1 {
+		return ErrCacheClosed
+	}
+	c.allocator.metadata.setFlag(metaFlagDestroyPending)
+	return c.Close()
+}
+
+// unregister 从进程注册表中移除, 返回true表示是最后一个退出的进程, 需要删除已经Destroy的共享内存
+func (c *cache) unregister() bool {
+	if c.readOnly {
+		return false
+	}
+	meta := c.allocator.metadata
+	c.procMu.Lock()
+	defer c.procMu.Unlock()
+	remove := false
+	// slot已经被其他进程清理的话Refs也已经减过了, 不能再减一次
+	if meta.Procs.unregister(c.slot, c.owner) {
+		remove = atomic.AddInt32(&meta.Refs, -1) <= 0
+	} else {
+		remove = atomic.LoadInt32(&meta.Refs) <= 0
+	}
+	// 心跳不会再重新注册
+	c.slot = -1
+	return remove && meta.hasFlag(metaFlagDestroyPending)
+}
+
+// detach 解除映射, remove为true时负责删除已经Destroy的共享内存
+func (c *cache) detach(remove bool) error {
+	mem := c.allocator.mem
+	if c.locked {
+		_ = munlock(mem)
+	}
+	var err error
+	if remove && c.memoryType == SHM {
+		// 先标记删除, 已经挂载的进程不受影响, 内核会在最后一次detach后释放
+		err = removeSHM(mem)
+	}
+	// 删除失败也要解除映射, 否则映射一直泄漏到进程退出
+	if derr := mem.Detach(); derr != nil || err != nil {
+		return errors.Join(err, derr)
+	}
+	if remove && (c.memoryType == MMAP || c.memoryType == HUGEPAGE) {
+		if c.durable {
+			for _, suffix := range []string{checkpointSuffix, walSuffix, attachLockSuffix} {
+				if err := os.Remove(c.memoryKey + suffix); err != nil && !os.IsNotExist(err) {
+					return err
+				}
 			}
-			retry--
-			time.Sleep(time.Second)
 		}
+		return os.Remove(c.memoryKey)
 	}
 	return nil
 }
 
-func (c *cache) shard(hash uint64) *shard {
-	index := hash % uint64(c.shards.Len())
-	return c.shards.shard(c.allocator, int(index))
+// enter 标记一个正在进行的操作, 必须先增加inProcess再检查closed, 这样Close才不会漏掉已经开始的操作
+func (c *cache) enter() bool {
+	atomic.AddInt32(&c.inProcess, 1)
+	if atomic.LoadUint32(&c.closed) == 1 {
+		atomic.AddInt32(&c.inProcess, -1)
+		return false
+	}
+	return true
+}
+
+func (c *cache) exit() {
+	atomic.AddInt32(&c.inProcess, -1)
+}
+
+// hasReadOnly 只读模式下的Has, 不加锁
+func (c *cache) hasReadOnly(hash uint64, key []byte) (count uint8, ok bool) {
+	shr := c.shard(hash, key)
+	shr.optimisticRead(c.allocator, hash, key, func(node *dataNode, el *hashmapBucketElement) {
+		if node == nil {
+			count, ok = 0, false
+			return
+		}
+		count, ok = node.count, true
+	})
+	return
+}
+
+// peekReadOnly 只读模式下的读取, 不加锁, 不会修改LRU和计数
+func (c *cache) peekReadOnly(hash uint64, key []byte) (value []byte, count uint8, err error) {
+	shr := c.shard(hash, key)
+	shr.optimisticRead(c.allocator, hash, key, func(node *dataNode, el *hashmapBucketElement) {
+		if node == nil {
+			value, count, err = nil, 0, ErrNotFound
+			return
+		}
+		value, count, err = el.value(), node.count, nil
+	})
+	return
+}
+
+func (c *cache) peekReadOnlyWithBuffer(hash uint64, key []byte, buffer io.Writer) error {
+	// 乐观读取可能会重试, 不能直接写入buffer
+	value, _, err := c.peekReadOnly(hash, key)
+	if err != nil {
+		return err
+	}
+	_, err = buffer.Write(value)
+	return err
+}
+
+// peekReadOnlyAppend 乐观读取重试时先截断到dst原来的长度, 避免追加多次
+func (c *cache) peekReadOnlyAppend(hash uint64, key []byte, dst []byte) (result []byte, err error) {
+	n := len(dst)
+	shr := c.shard(hash, key)
+	shr.optimisticRead(c.allocator, hash, key, func(node *dataNode, el *hashmapBucketElement) {
+		if node == nil {
+			result, err = dst[:n], ErrNotFound
+			return
+		}
+		dst = el.appendValue(dst[:n])
+		result, err = dst, nil
+	})
+	return
+}
+
+func (c *cache) shard(hash uint64, key []byte) *shard {
+	return c.shards.shard(c.allocator, c.shardIndex(hash, key))
+}
+
+// shardIndex 开启HashTags并且key中有hash tag时只用tag选择分片, hashmap中仍然使用整个key的hash
+func (c *cache) shardIndex(hash uint64, key []byte) int {
+	if c.hashTags {
+		if tag := hashTag(key); tag != nil {
+			hash = xxHashBytes(tag)
+		}
+	}
+	return int(hash % uint64(c.shards.Len()))
+}
+
+// hashTag 返回key中第一个{和之后第一个}之间的部分, 和Redis一样, 没有或者为空时返回nil
+func hashTag(key []byte) []byte {
+	start := bytes.IndexByte(key, '{')
+	if start < 0 {
+		return nil
+	}
+	end := bytes.IndexByte(key[start+1:], '}')
+	if end <= 0 {
+		return nil
+	}
+	return key[start+1 : start+1+end]
 }
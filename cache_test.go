@@ -1,10 +1,24 @@
 package fastcache
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestCache(t *testing.T) {
@@ -57,3 +71,2455 @@ func TestCache(t *testing.T) {
 
 	wg.Wait()
 }
+
+// newIncompatibleSegment 模拟一个不同布局的二进制创建的共享内存
+func newIncompatibleSegment(t *testing.T) (Cache, string) {
+	key := filepath.Join(t.TempDir(), "layout")
+	c, err := NewCache(16*MB, &Config{MemoryType: MMAP, MemoryKey: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.(*cache).allocator.metadata.Layout++
+	return c, key
+}
+
+func TestCacheIncompatibleLayout(t *testing.T) {
+	c, key := newIncompatibleSegment(t)
+	defer c.Close()
+
+	_, err := NewCache(16*MB, &Config{MemoryType: MMAP, MemoryKey: key})
+	var layoutErr *IncompatibleSegmentError
+	if !errors.As(err, &layoutErr) || !errors.Is(err, ErrIncompatibleSegment) {
+		t.Fatalf("expect IncompatibleSegmentError, got: %v", err)
+	}
+	if layoutErr.Expected != layoutFingerprint || layoutErr.Actual != layoutFingerprint+1 {
+		t.Fatalf("expect fingerprint %#x, got %#x, actual %#x", layoutFingerprint, layoutErr.Expected, layoutErr.Actual)
+	}
+}
+
+func TestCacheIncompatibleLayoutReadOnly(t *testing.T) {
+	c, key := newIncompatibleSegment(t)
+	defer c.Close()
+
+	// 只读进程按指针强转同样会读错数据
+	if _, err := NewCache(16*MB, &Config{MemoryType: MMAP, MemoryKey: key, ReadOnly: true}); !errors.Is(err, ErrIncompatibleSegment) {
+		t.Fatalf("expect ErrIncompatibleSegment, got: %v", err)
+	}
+}
+
+func TestCacheIncompatibleLayoutBeforeConfig(t *testing.T) {
+	c, key := newIncompatibleSegment(t)
+	defer c.Close()
+
+	// 布局检查先于config hash, 配置不同时也报告布局不兼容
+	if _, err := NewCache(16*MB, &Config{MemoryType: MMAP, MemoryKey: key, Shards: 3}); !errors.Is(err, ErrIncompatibleSegment) {
+		t.Fatalf("expect ErrIncompatibleSegment, got: %v", err)
+	}
+}
+
+func TestCacheLayoutFingerprint(t *testing.T) {
+	if computeLayoutFingerprint() != layoutFingerprint {
+		t.Fatal("expect a stable layout fingerprint")
+	}
+	c, err := NewCache(16*MB, &Config{MemoryType: GO})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if layout := c.(*cache).allocator.metadata.Layout; layout != layoutFingerprint {
+		t.Fatalf("expect new segment stamped with %#x, got %#x", layoutFingerprint, layout)
+	}
+}
+
+// newReadOnlyPair 同一个MMAP文件的写进程和只读进程
+func newReadOnlyPair(t *testing.T) (writer Cache, reader Cache) {
+	key := filepath.Join(t.TempDir(), "readonly")
+	writer, err := NewCache(16*MB, &Config{MemoryType: MMAP, MemoryKey: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = writer.Close() })
+	if reader, err = NewCache(16*MB, &Config{MemoryType: MMAP, MemoryKey: key, ReadOnly: true}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = reader.Close() })
+	return writer, reader
+}
+
+func TestCacheReadOnlyUninitialized(t *testing.T) {
+	key := filepath.Join(t.TempDir(), "readonly")
+	if _, err := NewCache(16*MB, &Config{MemoryType: MMAP, MemoryKey: key, ReadOnly: true}); !errors.Is(err, ErrSegmentNotInitialized) {
+		t.Fatalf("expect ErrSegmentNotInitialized, got: %v", err)
+	}
+	// 只读进程不能创建文件
+	if _, err := os.Stat(key); !os.IsNotExist(err) {
+		t.Fatalf("expect no file created, got: %v", err)
+	}
+}
+
+func TestCacheReadOnly(t *testing.T) {
+	writer, reader := newReadOnlyPair(t)
+	if err := writer.Set([]byte("k1"), []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	v, err := reader.Get([]byte("k1"))
+	if err != nil || string(v) != "v1" {
+		t.Fatalf("expect v1, got: %s, err: %v", v, err)
+	}
+	if _, err = reader.Get([]byte("missing")); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expect ErrNotFound, got: %v", err)
+	}
+}
+
+func TestCacheReadOnlyRejectsWrites(t *testing.T) {
+	writer, reader := newReadOnlyPair(t)
+	if err := writer.Set([]byte("k1"), []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := reader.Set([]byte("k2"), []byte("v2")); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expect ErrReadOnly, got: %v", err)
+	}
+	if err := reader.Delete([]byte("k1")); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expect ErrReadOnly, got: %v", err)
+	}
+	if !writer.Has([]byte("k1")) || writer.Has([]byte("k2")) {
+		t.Fatal("expect segment unchanged by the read only process")
+	}
+	// 只读进程不参与引用计数
+	if refs := writer.(*cache).allocator.metadata.Refs; refs != 1 {
+		t.Fatalf("expect 1 ref, got: %d", refs)
+	}
+}
+
+func TestCacheReadOnlySeesWrites(t *testing.T) {
+	writer, reader := newReadOnlyPair(t)
+	if err := writer.Set([]byte("k1"), []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Set([]byte("k1"), []byte("v1-new")); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := reader.Get([]byte("k1")); err != nil || string(v) != "v1-new" {
+		t.Fatalf("expect v1-new, got: %s, err: %v", v, err)
+	}
+	if err := writer.Delete([]byte("k1")); err != nil {
+		t.Fatal(err)
+	}
+	if reader.Has([]byte("k1")) {
+		t.Fatal("k1 should be deleted")
+	}
+}
+
+func TestCacheShardSafeFindOutOfBounds(t *testing.T) {
+	c, err := NewCache(16*MB, &Config{MemoryType: GO, Shards: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	key := []byte("k1")
+	if err = c.Set(key, []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	ca := c.(*cache)
+	all, hash := ca.allocator, xxHashBytes(key)
+	shr := ca.shard(hash, key)
+	node := shr.safeFind(all, hash, key)
+	if node == nil {
+		t.Fatal("expect k1 found")
+	}
+
+	// 读到写了一半的链表偏移量, 越过映射的末尾
+	bucket := shr.hashmap(all).byHash(all, hash)
+	first := bucket.linkedFirstOffset
+	bucket.linkedFirstOffset = all.mem.Size() - 8
+	if shr.safeFind(all, hash, key) != nil {
+		t.Fatal("expect out of bounds offset ignored")
+	}
+	bucket.linkedFirstOffset = first
+
+	// 元素头在范围内, key和value的长度越界
+	el := nodeTo[hashmapBucketElement](node)
+	valLen := el.valLen
+	el.valLen = math.MaxUint32
+	if shr.safeFind(all, hash, key) != nil {
+		t.Fatal("expect oversized element ignored")
+	}
+	el.valLen = valLen
+
+	// offset+size回绕
+	if all.inBounds(math.MaxUint64-4, 16) || all.inBounds(0, 16) {
+		t.Fatal("expect wrapped or metadata range out of bounds")
+	}
+	if shr.safeFind(all, hash, key) != node {
+		t.Fatal("expect k1 found again")
+	}
+}
+
+func TestCacheShardOptimisticReadWaitsWriter(t *testing.T) {
+	c, err := NewCache(16*MB, &Config{MemoryType: GO, Shards: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	key := []byte("k1")
+	if err = c.Set(key, []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	ca := c.(*cache)
+	all, hash := ca.allocator, xxHashBytes(key)
+	shr := ca.shard(hash, key)
+
+	// seq为奇数表示有进程正在修改, 读取需要等到修改结束
+	shr.beginWrite()
+	done := make(chan []byte)
+	go func() {
+		var v []byte
+		shr.optimisticRead(all, hash, key, func(node *dataNode, el *hashmapBucketElement) {
+			v = nil
+			if el != nil {
+				v = el.value()
+			}
+		})
+		done <- v
+	}()
+	select {
+	case <-done:
+		t.Fatal("expect read blocked while seq is odd")
+	case <-time.After(20 * time.Millisecond):
+	}
+	shr.endWrite()
+	if v := <-done; string(v) != "v1" {
+		t.Fatalf("expect v1, got: %s", v)
+	}
+}
+
+func TestCacheShardOptimisticReadConcurrent(t *testing.T) {
+	c, err := NewCache(16*MB, &Config{MemoryType: GO, Shards: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	key := []byte("k1")
+	ca := c.(*cache)
+	all, hash := ca.allocator, xxHashBytes(key)
+	shr := ca.shard(hash, key)
+
+	// 两个不同大小的value交替写入, 大小分类不同时元素会换一个节点
+	values := [][]byte{bytes.Repeat([]byte("a"), 100), bytes.Repeat([]byte("b"), 300)}
+	if err = c.Set(key, values[0]); err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := c.Set(key, values[i%2]); err != nil {
+				panic(err)
+			}
+			if i%16 == 0 {
+				runtime.Gosched()
+			}
+		}
+	}()
+	for i := 0; i < 2000; i++ {
+		var v []byte
+		shr.optimisticRead(all, hash, key, func(node *dataNode, el *hashmapBucketElement) {
+			v = nil
+			if el != nil {
+				v = el.value()
+			}
+		})
+		if !bytes.Equal(v, values[0]) && !bytes.Equal(v, values[1]) {
+			close(stop)
+			t.Fatalf("expect a complete value, got len %d", len(v))
+		}
+		runtime.Gosched()
+	}
+	close(stop)
+	<-done
+}
+
+func TestCacheDestroy(t *testing.T) {
+	key := filepath.Join(t.TempDir(), "destroy")
+	c1, err := NewCache(16*MB, &Config{MemoryType: MMAP, MemoryKey: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := NewCache(16*MB, &Config{MemoryType: MMAP, MemoryKey: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refs := c2.(*cache).allocator.metadata.Refs; refs != 2 {
+		t.Fatalf("expect 2 refs, got: %d", refs)
+	}
+
+	if err = c1.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(key); err != nil {
+		t.Fatalf("segment must exist until the last process leaves: %v", err)
+	}
+	if _, err = NewCache(16*MB, &Config{MemoryType: MMAP, MemoryKey: key}); !errors.Is(err, ErrSegmentDestroyed) {
+		t.Fatalf("expect ErrSegmentDestroyed, got: %v", err)
+	}
+	if err = c1.Set([]byte("k"), []byte("v")); !errors.Is(err, ErrCacheClosed) {
+		t.Fatalf("expect ErrCacheClosed, got: %v", err)
+	}
+
+	if err = c2.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(key); !os.IsNotExist(err) {
+		t.Fatalf("segment should be removed, got: %v", err)
+	}
+	// Close可以重复调用
+	if err = c2.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCacheDestroyAttachOnlySHM(t *testing.T) {
+	key := "fastcache_destroy_" + strconv.Itoa(os.Getpid())
+	c, err := NewCache(16*MB, &Config{MemoryType: SHM, MemoryKey: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tool, err := NewCache(16*MB, &Config{MemoryType: SHM, MemoryKey: key, AttachOnly: true})
+	if err != nil {
+		_ = c.Destroy()
+		t.Fatal(err)
+	}
+	if err = c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// 最后一个进程是只挂载的工具进程, 也要能删除SHM的key
+	if err = tool.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewCache(16*MB, &Config{MemoryType: SHM, MemoryKey: key, AttachOnly: true}); !errors.Is(err, ErrSegmentNotInitialized) {
+		t.Fatalf("expect shm key removed, got: %v", err)
+	}
+}
+
+func TestCacheProcesses(t *testing.T) {
+	key := filepath.Join(t.TempDir(), "processes")
+	c, err := NewCache(16*MB, &Config{MemoryType: MMAP, MemoryKey: key, HeartbeatInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// 一个已经退出的进程
+	cmd := exec.Command("true")
+	if err = cmd.Run(); err != nil {
+		t.Skip(err)
+	}
+	deadPid := int32(cmd.Process.Pid)
+	meta := c.(*cache).allocator.metadata
+	if _, _, err = meta.Procs.register(deadPid); err != nil {
+		t.Fatal(err)
+	}
+	atomic.AddInt32(&meta.Refs, 1)
+
+	// 死进程持有的锁可以被抢回来
+	shr := c.(*cache).shard(xxHashBytes([]byte("k1")), []byte("k1"))
+	locker := shr.locker(c.(*cache).allocator)
+	locker.write = deadPid
+	if err = c.Set([]byte("k1"), []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	procs := c.Processes()
+	if len(procs) != 1 || procs[0].PID != os.Getpid() {
+		t.Fatalf("expect only current process, got: %+v", procs)
+	}
+	if procs[0].Sets != 1 {
+		t.Fatalf("expect 1 set, got: %d", procs[0].Sets)
+	}
+	if processCheckable {
+		// 启动时间只精确到clock tick, 而且在挂载之前
+		started := procs[0].Started
+		if started.IsZero() || started.After(procs[0].Attached) || time.Since(started) > time.Hour {
+			t.Fatalf("expect started before attached, got: %v, attached: %v", started, procs[0].Attached)
+		}
+	}
+	if atomic.LoadInt32(&meta.Refs) != 1 {
+		t.Fatalf("expect 1 ref, got: %d", meta.Refs)
+	}
+}
+
+func TestCacheProcessPrune(t *testing.T) {
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skip(err)
+	}
+	deadPid := int32(cmd.Process.Pid)
+
+	var procs procTable
+	live, liveOwner, err := procs.register(selfPid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead, deadOwner, err := procs.register(deadPid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 心跳晚了但是进程还在, 不能被清理
+	atomic.StoreInt64(&procs.slots[live].heartbeat, 0)
+	if pruned := procs.prune(-1, time.Second); pruned != 1 {
+		t.Fatalf("expect only dead process pruned, got: %d", pruned)
+	}
+	if !procs.heartbeat(live, liveOwner, 0, 0, 0) {
+		t.Fatal("expect live slot kept")
+	}
+	// 被清理的slot不能再写心跳, 注销也不能再减一次引用计数
+	if procs.heartbeat(dead, deadOwner, 0, 0, 0) {
+		t.Fatal("expect heartbeat on pruned slot rejected")
+	}
+	if procs.unregister(dead, deadOwner) {
+		t.Fatal("expect unregister on pruned slot rejected")
+	}
+	// slot被重新注册之后旧的owner也不能注销
+	again, _, err := procs.register(selfPid)
+	if err != nil || again != dead {
+		t.Fatalf("expect pruned slot reused, got: %d, %v", again, err)
+	}
+	if procs.unregister(dead, deadOwner) {
+		t.Fatal("expect unregister with old owner rejected")
+	}
+	if procs.live() != 2 {
+		t.Fatalf("expect 2 live processes, got: %d", procs.live())
+	}
+
+	// 其他pid命名空间的进程没有办法用kill判断, 只看心跳
+	other, _, err := procs.register(deadPid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreUint64(&procs.slots[other].pidNS, selfPidNS+1)
+	if pruned := procs.prune(-1, time.Second); pruned != 0 {
+		t.Fatalf("expect process in other namespace kept, got: %d", pruned)
+	}
+	atomic.StoreInt64(&procs.slots[other].heartbeat, 0)
+	if pruned := procs.prune(-1, time.Second); pruned != 1 {
+		t.Fatalf("expect stale process in other namespace pruned, got: %d", pruned)
+	}
+}
+
+func TestCacheProcessReregister(t *testing.T) {
+	key := filepath.Join(t.TempDir(), "reregister")
+	c, err := NewCache(16*MB, &Config{MemoryType: MMAP, MemoryKey: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := c.(*cache)
+	meta := ca.allocator.metadata
+	// 模拟心跳停了太久被其他进程清理
+	if !meta.Procs.unregister(ca.slot, ca.owner) {
+		t.Fatal("expect unregister")
+	}
+	atomic.AddInt32(&meta.Refs, -1)
+
+	ca.heartbeat(time.Second)
+	if meta.Procs.live() != 1 || atomic.LoadInt32(&meta.Refs) != 1 {
+		t.Fatalf("expect registered again, live: %d, refs: %d", meta.Procs.live(), meta.Refs)
+	}
+	if err = c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = NewCache(16*MB, &Config{MemoryType: MMAP, MemoryKey: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	meta = c.(*cache).allocator.metadata
+	if meta.Procs.live() != 1 || atomic.LoadInt32(&meta.Refs) != 1 {
+		t.Fatalf("expect only reopened process, live: %d, refs: %d", meta.Procs.live(), meta.Refs)
+	}
+}
+
+func TestCacheLockerStale(t *testing.T) {
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skip(err)
+	}
+	deadPid := int32(cmd.Process.Pid)
+	ppid := int32(os.Getppid())
+	if processStartTime(ppid) == 0 {
+		t.Skip("process start time not available")
+	}
+
+	// pid被复用: 进程还在但是启动时间对不上
+	l := &processLocker{write: ppid, started: processStartTime(ppid) + 1}
+	if !l.recoverStale(nil) {
+		t.Fatal("expect lock of reused pid recovered")
+	}
+	l = &processLocker{write: ppid, started: processStartTime(ppid)}
+	if l.recoverStale(nil) {
+		t.Fatal("expect lock of live process kept")
+	}
+
+	// 持有者在其他pid命名空间中, kill看不到, 以注册表中的心跳为准
+	var procs procTable
+	slot, _, err := procs.register(deadPid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreUint64(&procs.slots[slot].pidNS, selfPidNS+1)
+	h := &allocator{metadata: &metadata{}, procTimeout: time.Second}
+	h.metadata.Procs = procs
+	l = &processLocker{write: deadPid, started: selfStartTime}
+	if l.recoverStale(h) {
+		t.Fatal("expect lock held by other namespace kept")
+	}
+	atomic.StoreInt64(&h.metadata.Procs.slots[slot].heartbeat, 0)
+	if !l.recoverStale(h) || l.write != selfPid {
+		t.Fatal("expect lock of stale holder recovered")
+	}
+}
+
+func TestCacheLeaderElection(t *testing.T) {
+	key := filepath.Join(t.TempDir(), "leader")
+	config := &Config{MemoryType: MMAP, MemoryKey: key, LeaderLease: 30 * time.Millisecond}
+	c1, err := NewCache(16*MB, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := NewCache(16*MB, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caches := []Cache{c1, c2}
+
+	var runs [2]int32
+	for i, c := range caches {
+		i := i
+		err = c.RegisterMaintenance("count", time.Millisecond, func(ctx context.Context) {
+			atomic.AddInt32(&runs[i], 1)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if c1.IsLeader() == c2.IsLeader() {
+		t.Fatalf("expect exactly one leader, c1: %v, c2: %v", c1.IsLeader(), c2.IsLeader())
+	}
+	leader := 0
+	if c2.IsLeader() {
+		leader = 1
+	}
+	follower := 1 - leader
+	defer caches[follower].Close()
+
+	// 主进程退出之后, 其他进程接管维护任务
+	if err = caches[leader].Close(); err != nil {
+		t.Fatal(err)
+	}
+	before := atomic.LoadInt32(&runs[follower])
+	time.Sleep(100 * time.Millisecond)
+	if !caches[follower].IsLeader() {
+		t.Fatal("follower should take over the leadership")
+	}
+	if atomic.LoadInt32(&runs[follower]) == before {
+		t.Fatal("maintenance task should run on the new leader")
+	}
+}
+
+func TestCacheRegisterMaintenanceReserved(t *testing.T) {
+	key := filepath.Join(t.TempDir(), "maintenance")
+	c, err := NewCache(16*MB, &Config{MemoryType: MMAP, MemoryKey: key, Durable: true, CheckpointInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	fn := func(ctx context.Context) {}
+	if err = c.RegisterMaintenance(internalTaskPrefix+"checkpoint", time.Second, fn); !errors.Is(err, ErrReservedTaskName) {
+		t.Fatalf("expect ErrReservedTaskName, got: %v", err)
+	}
+	if err = c.RegisterMaintenance("zero", 0, fn); !errors.Is(err, ErrInvalidMaintenance) {
+		t.Fatalf("expect ErrInvalidMaintenance for zero interval, got: %v", err)
+	}
+	if err = c.RegisterMaintenance("nil", time.Second, nil); !errors.Is(err, ErrInvalidMaintenance) {
+		t.Fatalf("expect ErrInvalidMaintenance for nil fn, got: %v", err)
+	}
+	// 和内部任务同名也不会覆盖内部的checkpoint任务
+	if err = c.RegisterMaintenance("checkpoint", time.Second, fn); err != nil {
+		t.Fatal(err)
+	}
+	m := &c.(*cache).maintenance
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.tasks) != 2 || m.tasks[internalTaskPrefix+"checkpoint"] == nil {
+		t.Fatalf("expect internal checkpoint task kept, got: %v", m.tasks)
+	}
+}
+
+func TestCacheLeaderLease(t *testing.T) {
+	var procs procTable
+	var lease leaderLease
+	slot1, owner1, _ := procs.register(selfPid)
+	slot2, owner2, _ := procs.register(selfPid)
+	a, b := leaseOwner(slot1, owner1), leaseOwner(slot2, owner2)
+
+	epoch, ok := lease.acquire(&procs, a, 0, time.Minute, time.Second)
+	if !ok || epoch != 1 {
+		t.Fatalf("expect a to be leader, got: %d, %v", epoch, ok)
+	}
+	if _, ok = lease.acquire(&procs, b, 0, time.Minute, time.Second); ok {
+		t.Fatal("expect b rejected while a holds the lease")
+	}
+	if epoch, ok = lease.acquire(&procs, a, epoch, time.Minute, time.Second); !ok || epoch != 1 {
+		t.Fatalf("expect a renewed, got: %d, %v", epoch, ok)
+	}
+
+	// a注销之后slot被重新注册, 新的进程不能继承a的租约
+	procs.unregister(slot1, owner1)
+	if again, _, _ := procs.register(selfPid); again != slot1 {
+		t.Fatalf("expect slot %d reused, got: %d", slot1, again)
+	}
+	epoch, ok = lease.acquire(&procs, b, 0, time.Minute, time.Second)
+	if !ok || epoch != 2 {
+		t.Fatalf("expect b to take over, got: %d, %v", epoch, ok)
+	}
+	if _, ok = lease.acquire(&procs, a, 1, time.Minute, time.Second); ok {
+		t.Fatal("expect old leader to lose the lease")
+	}
+
+	lease.release(b, epoch)
+	if epoch, ok = lease.acquire(&procs, a, 0, time.Minute, time.Second); !ok || epoch != 3 {
+		t.Fatalf("expect lease free after release, got: %d, %v", epoch, ok)
+	}
+}
+
+func TestCacheAllocAlign(t *testing.T) {
+	c, err := NewCache(16*MB, &Config{MemoryType: GO, Shards: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	all := c.(*cache).allocator
+	for _, size := range []uint64{1, 3, 7, 9, 13} {
+		_, offset, err := all.alloc(size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if offset%allocAlign != 0 || all.metadata.Used%allocAlign != 0 {
+			t.Fatalf("expect aligned allocation of %d bytes, offset: %d, used: %d", size, offset, all.metadata.Used)
+		}
+	}
+	shrs := c.(*cache).shards
+	for i := uint32(0); i < shrs.Len(); i++ {
+		if offset := shrs.shard(all, int(i)).lockerOffset; offset%allocAlign != 0 {
+			t.Fatalf("expect shard %d locker aligned, offset: %d", i, offset)
+		}
+	}
+}
+
+func TestCacheElementSize(t *testing.T) {
+	// README中按32字节的元素头计算每个元素占用的内存
+	if sizeOfHashmapBucketElement != 32 || sizeOfLRUNode != 16 || sizeOfDataNode != 16 {
+		t.Fatalf("element header changed: %d + %d + %d", sizeOfDataNode, sizeOfHashmapBucketElement, sizeOfLRUNode)
+	}
+	for _, tc := range []struct{ keyLen, valLen, class uint64 }{{16, 8, 128}, {16, 32, 128}, {8, 8, 64}, {32, 1000, 2048}} {
+		index, err := hashmapElementIndex(tc.keyLen, tc.valLen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if class := uint64(1) << index; class != tc.class {
+			t.Fatalf("expect key %d value %d in class %d, got: %d", tc.keyLen, tc.valLen, tc.class, class)
+		}
+	}
+}
+
+func TestCacheVerify(t *testing.T) {
+	c, err := NewCache(16*MB, &Config{MemoryType: GO, Shards: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key_%d", i))
+		if err = c.Set(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	report, err := c.Verify(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Shards != 4 || len(report.Corrupted) != 0 {
+		t.Fatalf("expect no corrupted shards, got: %+v", report)
+	}
+
+	// 破坏一个分片的hashmap长度
+	ca := c.(*cache)
+	ca.shards.shard(ca.allocator, 1).hashmap(ca.allocator).len++
+	report, _ = c.Verify(false)
+	if len(report.Corrupted) != 1 || report.Corrupted[0].Index != 1 || report.Corrupted[0].Repaired {
+		t.Fatalf("expect shard 1 corrupted, got: %+v", report)
+	}
+
+	report, _ = c.Verify(true)
+	if len(report.Corrupted) != 1 || !report.Corrupted[0].Repaired {
+		t.Fatalf("expect shard 1 repaired, got: %+v", report)
+	}
+	report, _ = c.Verify(false)
+	if len(report.Corrupted) != 0 {
+		t.Fatalf("expect no corrupted shards after repair, got: %+v", report)
+	}
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key_%d", i))
+		if err = c.Set(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if report, _ = c.Verify(false); len(report.Corrupted) != 0 {
+		t.Fatalf("expect no corrupted shards, got: %+v", report)
+	}
+}
+
+func TestCacheVerifyReadOnly(t *testing.T) {
+	key := filepath.Join(t.TempDir(), "verify")
+	config := &Config{MemoryType: MMAP, MemoryKey: key, Shards: 1}
+	c, err := NewCache(16*MB, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	rc, err := NewCache(16*MB, &Config{MemoryType: MMAP, MemoryKey: key, Shards: 1, ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	// 只读进程检查的同时有进程在写, 不能把写了一半的数据报告成损坏
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			key := []byte(strconv.Itoa(i % 500))
+			_ = c.Set(key, bytes.Repeat(key, i%64+1))
+			if i%3 == 0 {
+				_ = c.Delete(key)
+			}
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		report, err := rc.Verify(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Corrupted) != 0 {
+			close(stop)
+			wg.Wait()
+			t.Fatalf("expect no corrupted shards, got: %+v", report)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestCacheAttachOnly(t *testing.T) {
+	key := filepath.Join(t.TempDir(), "attach")
+	if _, err := NewCache(16*MB, &Config{MemoryType: MMAP, MemoryKey: key, AttachOnly: true}); !errors.Is(err, ErrSegmentNotInitialized) {
+		t.Fatalf("expect ErrSegmentNotInitialized, got: %v", err)
+	}
+	if _, err := os.Stat(key); !os.IsNotExist(err) {
+		t.Fatalf("expect segment not created, got: %v", err)
+	}
+
+	c, err := NewCache(16*MB, &Config{MemoryType: MMAP, MemoryKey: key, Shards: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err = c.Set([]byte("k"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	tool, err := NewCache(16*MB, &Config{MemoryType: MMAP, MemoryKey: key, Shards: 2, AttachOnly: true,
+		LeaderLease: 3 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := tool.(*cache)
+	ca.shards.shard(ca.allocator, 0).hashmap(ca.allocator).len++
+	report, err := tool.Verify(true)
+	if err != nil || len(report.Corrupted) != 1 || !report.Corrupted[0].Repaired {
+		t.Fatalf("expect shard 0 repaired, got: %+v, %v", report, err)
+	}
+	// 不参与选主
+	time.Sleep(10 * time.Millisecond)
+	if tool.IsLeader() {
+		t.Fatal("expect attach only cache not elected")
+	}
+	if err = tool.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if refs := atomic.LoadInt32(&c.(*cache).allocator.metadata.Refs); refs != 1 {
+		t.Fatalf("expect 1 ref after tool closed, got: %d", refs)
+	}
+}
+
+func TestCacheAttachOnlyForeignConfig(t *testing.T) {
+	key := filepath.Join(t.TempDir(), "foreign")
+	c, err := NewCache(16*MB, &Config{MemoryType: MMAP, MemoryKey: key, Shards: 2, MaxElementLen: 100000,
+		MaxMemorySize: 64 * MB, Durable: true, WAL: true, BigDataSize: 32 * KB, MaxBigDataLen: 10000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	value := make([]byte, 2000)
+	n := 8000
+	for i := 0; i < n; i++ {
+		if err = c.Set([]byte(fmt.Sprintf("key_%d", i)), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if meta := c.(*cache).allocator.metadata; meta.TotalSize <= 16*MB {
+		t.Fatalf("expect segment grown, total size: %d", meta.TotalSize)
+	}
+
+	// fastcache-fsck只知道创建时的大小, 分片和扩容之后的大小都从共享内存读取
+	for _, config := range []*Config{
+		{MemoryType: MMAP, MemoryKey: key, ReadOnly: true},
+		{MemoryType: MMAP, MemoryKey: key, AttachOnly: true},
+	} {
+		tool, err := NewCache(16*MB, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		report, err := tool.Verify(config.AttachOnly)
+		if err != nil || len(report.Corrupted) != 0 || report.Shards != 2 {
+			t.Fatalf("expect 2 clean shards, got: %+v, %v", report, err)
+		}
+		if !tool.Has([]byte(fmt.Sprintf("key_%d", n-1))) {
+			t.Fatal("expect key in grown region visible")
+		}
+		if err = tool.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = NewCache(64*MB+1, &Config{MemoryType: MMAP, MemoryKey: key, ReadOnly: true}); !errors.Is(err, ErrSegmentNotInitialized) {
+		t.Fatalf("expect ErrSegmentNotInitialized for size larger than segment, got: %v", err)
+	}
+}
+
+func TestCacheShardRecovery(t *testing.T) {
+	c, err := NewCache(16*MB, &Config{MemoryType: GO, Shards: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for _, k := range []string{"k1", "k2"} {
+		if err = c.Set([]byte(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ca := c.(*cache)
+	shr := ca.shards.shard(ca.allocator, 0)
+
+	// 模拟一个进程在写k1的过程中退出, 分片结构完整, 只回滚k1
+	shr.beginWrite()
+	shr.markDirty(undoSet, xxHashBytes([]byte("k1")))
+	if c.Has([]byte("k1")) || !c.Has([]byte("k2")) {
+		t.Fatal("expect only k1 rolled back")
+	}
+
+	// 模拟一个进程在删除的过程中退出, 分片结构已经被破坏, 重置整个分片
+	shr.beginWrite()
+	shr.markDirty(undoDelete, xxHashBytes([]byte("k2")))
+	shr.hashmap(ca.allocator).len++
+	if c.Has([]byte("k2")) {
+		t.Fatal("expect shard reset")
+	}
+	if err = c.Set([]byte("k3"), []byte("k3")); err != nil {
+		t.Fatal(err)
+	}
+	if report, _ := c.Verify(false); len(report.Corrupted) != 0 {
+		t.Fatalf("expect no corrupted shards, got: %+v", report)
+	}
+}
+
+func TestCacheDurable(t *testing.T) {
+	key := filepath.Join(t.TempDir(), "durable")
+	config := &Config{MemoryType: MMAP, MemoryKey: key, Shards: 4, Durable: true}
+	c, err := NewCache(16*MB, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Set([]byte("k1"), []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Set([]byte("k2"), []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 模拟进程崩溃: 没有Close直接解除映射, 最后一次checkpoint之后的修改不可信
+	ca := c.(*cache)
+	ca.stopBackground()
+	ca.allocator.metadata.Procs.unregister(ca.slot, ca.owner)
+	if err = ca.allocator.mem.Detach(); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = NewCache(16*MB, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := c.Get([]byte("k1")); err != nil || string(v) != "v1" {
+		t.Fatalf("expect k1 restored from checkpoint, got: %s, %v", v, err)
+	}
+	if c.Has([]byte("k2")) {
+		t.Fatal("expect k2 lost after crash")
+	}
+	if err = c.Set([]byte("k3"), []byte("v3")); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 正常关闭会checkpoint, 重新打开数据完整
+	c, err = NewCache(16*MB, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"k1", "k3"} {
+		if !c.Has([]byte(k)) {
+			t.Fatalf("expect %s after clean close", k)
+		}
+	}
+	if err = c.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(key + checkpointSuffix); !os.IsNotExist(err) {
+		t.Fatalf("expect checkpoint file removed, got: %v", err)
+	}
+
+	if _, err = NewCache(16*MB, &Config{MemoryType: GO, Durable: true}); err == nil {
+		t.Fatal("expect durable GO cache rejected")
+	}
+	gc, err := NewCache(16*MB, &Config{MemoryType: GO})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gc.Close()
+	if err = gc.Checkpoint(); !errors.Is(err, ErrNotDurable) {
+		t.Fatalf("expect ErrNotDurable, got: %v", err)
+	}
+}
+
+func TestCacheDurableForeignSegment(t *testing.T) {
+	dir := t.TempDir()
+	key := filepath.Join(dir, "plain")
+	config := &Config{MemoryType: MMAP, MemoryKey: key, Shards: 4}
+	c, err := NewCache(16*MB, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Set([]byte("k1"), []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 另一个持久化缓存留下的checkpoint文件, 不能恢复到不持久化的文件上
+	other := filepath.Join(dir, "other")
+	d, err := NewCache(16*MB, &Config{MemoryType: MMAP, MemoryKey: other, Shards: 4, Durable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = d.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(other + checkpointSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 没有checkpoint文件时不能重置, 有的时候不能覆盖, 都应该返回config changed
+	for _, withCheckpoint := range []bool{false, true} {
+		if withCheckpoint {
+			if err = os.WriteFile(key+checkpointSuffix, data, 0o666); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err = NewCache(16*MB, &Config{MemoryType: MMAP, MemoryKey: key, Shards: 4, Durable: true}); err == nil {
+			t.Fatal("expected config changed error")
+		}
+	}
+
+	c, err = NewCache(16*MB, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if v, err := c.Get([]byte("k1")); err != nil || string(v) != "v1" {
+		t.Fatal("segment overwritten", string(v), err)
+	}
+}
+
+func TestCacheWAL(t *testing.T) {
+	key := filepath.Join(t.TempDir(), "wal")
+	config := &Config{MemoryType: MMAP, MemoryKey: key, Shards: 4, Durable: true, WAL: true, WALSync: WALSyncAlways}
+	crash := func(c Cache) {
+		ca := c.(*cache)
+		ca.stopBackground()
+		_ = ca.allocator.wal.close()
+		ca.allocator.metadata.Procs.unregister(ca.slot, ca.owner)
+		if err := ca.allocator.mem.Detach(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := NewCache(16*MB, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"k1", "k2"} {
+		if err = c.Set([]byte(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 还没有checkpoint过也可以通过WAL恢复
+	crash(c)
+	if c, err = NewCache(16*MB, config); err != nil {
+		t.Fatal(err)
+	}
+	if !c.Has([]byte("k1")) || !c.Has([]byte("k2")) {
+		t.Fatal("expect k1 and k2 replayed from wal")
+	}
+
+	if err = c.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(key + walSuffix); err != nil || info.Size() != int64(walHeaderSize) {
+		t.Fatalf("expect wal compacted after checkpoint, got: %v, %v", info, err)
+	}
+	if err = c.Set([]byte("k3"), []byte("v3")); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Delete([]byte("k1")); err != nil {
+		t.Fatal(err)
+	}
+	crash(c)
+
+	// 崩溃时没有写完的记录
+	f, err := os.OpenFile(key+walSuffix, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write([]byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if c, err = NewCache(16*MB, config); err != nil {
+		t.Fatal(err)
+	}
+	if c.Has([]byte("k1")) {
+		t.Fatal("expect k1 deleted by wal replay")
+	}
+	if v, err := c.Get([]byte("k3")); err != nil || string(v) != "v3" {
+		t.Fatalf("expect k3 replayed from wal, got: %s, %v", v, err)
+	}
+	if !c.Has([]byte("k2")) {
+		t.Fatal("expect k2 from checkpoint")
+	}
+
+	// 不完整的记录已经被截断, 之后追加的记录可以重放
+	if err = c.Set([]byte("k4"), []byte("v4")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.IncrWithTTL([]byte("counter"), 1, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	crash(c)
+	if c, err = NewCache(16*MB, config); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !c.Has([]byte("k4")) {
+		t.Fatal("expect k4 replayed after torn record")
+	}
+	// 过期时间和计数器一起重放
+	if n, err := c.Incr([]byte("counter"), 1); err != nil || n != 2 {
+		t.Fatalf("expect counter replayed, got: %d, %v", n, err)
+	}
+	ca := c.(*cache)
+	hash := xxHashBytes([]byte("counter"))
+	_, node := ca.shard(hash, []byte("counter")).hashmap(ca.allocator).find(ca.allocator, hash, []byte("counter"))
+	if node == nil || nodeTo[hashmapBucketElement](node).expireAt == 0 {
+		t.Fatal("expect counter expiry replayed")
+	}
+}
+
+func TestCacheCheckpointConcurrent(t *testing.T) {
+	key := filepath.Join(t.TempDir(), "ckpt")
+	config := &Config{MemoryType: MMAP, MemoryKey: key, Shards: 4, Durable: true, WAL: true, WALSync: WALSyncAlways}
+	c, err := NewCache(16*MB, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// checkpoint期间写入的记录不能在压缩WAL时丢掉
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 20; i++ {
+			if err := c.Checkpoint(); err != nil {
+				done <- err
+				return
+			}
+			runtime.Gosched()
+		}
+		done <- nil
+	}()
+	n := 0
+	for checkpointing := true; checkpointing; n++ {
+		select {
+		case err = <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkpointing = false
+		default:
+		}
+		if err = c.Set([]byte(fmt.Sprintf("key_%d", n)), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ca := c.(*cache)
+	ca.stopBackground()
+	_ = ca.allocator.wal.close()
+	ca.allocator.metadata.Procs.unregister(ca.slot, ca.owner)
+	if err = ca.allocator.mem.Detach(); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(key); err != nil {
+		t.Fatal(err)
+	}
+
+	// 只能从checkpoint文件加WAL恢复
+	if c, err = NewCache(16*MB, config); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+	for i := 0; i < n; i++ {
+		if !c.Has([]byte(fmt.Sprintf("key_%d", i))) {
+			t.Fatalf("expect key_%d of %d recovered", i, n)
+		}
+	}
+}
+
+func TestCacheWALGenerationLag(t *testing.T) {
+	key := filepath.Join(t.TempDir(), "lag")
+	config := &Config{MemoryType: MMAP, MemoryKey: key, Shards: 4, Durable: true, WAL: true, WALSync: WALSyncAlways}
+	c, err := NewCache(16*MB, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Set([]byte("k1"), []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Set([]byte("k2"), []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+	ca := c.(*cache)
+	ca.stopBackground()
+	generation := ca.allocator.metadata.Checkpoint.Generation
+	_ = ca.allocator.wal.close()
+	ca.allocator.metadata.Procs.unregister(ca.slot, ca.owner)
+	if err = ca.allocator.mem.Detach(); err != nil {
+		t.Fatal(err)
+	}
+
+	// checkpoint文件已经替换, 还没来得及压缩WAL就崩溃了: WAL的generation比checkpoint小一代
+	f, err := os.OpenFile(key+walSuffix, os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteAt(binary.LittleEndian.AppendUint64(nil, generation-1), int64(len(walMagic))); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if c, err = NewCache(16*MB, config); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+	for _, k := range []string{"k1", "k2"} {
+		if !c.Has([]byte(k)) {
+			t.Fatalf("expect %s recovered", k)
+		}
+	}
+}
+
+func TestCacheAttachLock(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("flock only on linux")
+	}
+	key := filepath.Join(t.TempDir(), "attach")
+	unlock, err := lockFile(key + attachLockSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 别的进程正在挂载时必须等待
+	done := make(chan Cache)
+	go func() {
+		c, err := NewCache(16*MB, &Config{MemoryType: MMAP, MemoryKey: key, Shards: 4, Durable: true})
+		if err != nil {
+			t.Error(err)
+		}
+		done <- c
+	}()
+	select {
+	case <-done:
+		t.Fatal("expect attach blocked by the attach lock")
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock()
+	c := <-done
+	if c == nil {
+		t.FailNow()
+	}
+	if err = c.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCacheSnapshot(t *testing.T) {
+	src, err := NewCache(16*MB, &Config{MemoryType: GO, Shards: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key_%d", i))
+		if err = src.Set(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err = src.(*cache).GetWithCounter([]byte("key_1")); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = src.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// 快照和内存类型无关
+	dst, err := NewCache(16*MB, &Config{MemoryType: MMAP, MemoryKey: filepath.Join(t.TempDir(), "snapshot"), Shards: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	if err = dst.Restore(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key_%d", i))
+		if v, err := dst.Peek(key); err != nil || string(v) != string(key) {
+			t.Fatalf("expect %s restored, got: %s, %v", key, v, err)
+		}
+	}
+	if count, _ := dst.HasWithCounter([]byte("key_1")); count == 0 {
+		t.Fatal("expect counter restored")
+	}
+
+	corrupted := append([]byte(nil), buf.Bytes()...)
+	corrupted[len(corrupted)/2]++
+	if err = dst.Restore(bytes.NewReader(corrupted)); !errors.Is(err, ErrSnapshotInvalid) {
+		t.Fatalf("expect ErrSnapshotInvalid, got: %v", err)
+	}
+	if err = dst.Restore(bytes.NewReader(buf.Bytes()[:buf.Len()-1])); !errors.Is(err, ErrSnapshotInvalid) {
+		t.Fatalf("expect ErrSnapshotInvalid for truncated snapshot, got: %v", err)
+	}
+}
+
+func TestCacheSnapshotReadOnly(t *testing.T) {
+	key := filepath.Join(t.TempDir(), "snapshot")
+	writer, err := NewCache(16*MB, &Config{MemoryType: MMAP, MemoryKey: key, Shards: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key_%d", i))
+		if err = writer.Set(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reader, err := NewCache(16*MB, &Config{MemoryType: MMAP, MemoryKey: key, ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	// 快照期间其他进程继续写入
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			_ = writer.Set([]byte(fmt.Sprintf("other_%d", i%100)), []byte("v"))
+			runtime.Gosched()
+		}
+	}()
+	var buf bytes.Buffer
+	err = reader.Snapshot(&buf)
+	close(stop)
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := NewCache(16*MB, &Config{MemoryType: GO, Shards: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	if err = dst.Restore(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key_%d", i))
+		if v, err := dst.Peek(key); err != nil || string(v) != string(key) {
+			t.Fatalf("expect %s in the read only snapshot, got: %s, %v", key, v, err)
+		}
+	}
+}
+
+func TestCacheWarmRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.snapshot")
+	config := &Config{MemoryType: GO, SnapshotPath: path}
+	c, err := NewCache(16*MB, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key_%d", i))
+		if err = c.Set(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = NewCache(16*MB, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key_%d", i))
+		if !c.Has(key) {
+			t.Fatalf("expect %s restored from snapshot", key)
+		}
+	}
+	if err = c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 超过时间预算不会阻塞启动
+	c, err = NewCache(16*MB, &Config{MemoryType: GO, SnapshotPath: path, RestoreTimeout: time.Nanosecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Has([]byte("key_0")) {
+		t.Fatal("expect restore stopped by the time budget")
+	}
+	// 没有完整恢复的快照不能被覆盖
+	if err = c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c, err = NewCache(16*MB, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !c.Has([]byte("key_99")) {
+		t.Fatal("expect snapshot kept after partial restore")
+	}
+}
+
+func TestCacheMigrate(t *testing.T) {
+	src, err := NewCache(16*MB, &Config{MemoryType: GO, Shards: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	n := migrateBatch*3 + 1
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("key_%d", i))
+		if err = src.Set(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = src.Migrate(src); err == nil {
+		t.Fatal("expect migrating to itself rejected")
+	}
+
+	dst, err := NewCache(32*MB, &Config{MemoryType: MMAP, MemoryKey: filepath.Join(t.TempDir(), "migrate"), Shards: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	if err = src.Migrate(dst); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("key_%d", i))
+		if v, err := dst.Peek(key); err != nil || string(v) != string(key) {
+			t.Fatalf("expect %s migrated, got: %s, %v", key, v, err)
+		}
+	}
+
+	// 迁移后LRU的顺序不变, 最早写入的key在尾部, LRU按元素大小分开, 只比较同样长度的key
+	ca := dst.(*cache)
+	shr := ca.shards.shard(ca.allocator, 0)
+	var keys [][]byte
+	if err = shr.lruBatches(ca.allocator, migrateBatch, func(batch [][]byte) error {
+		keys = append(keys, batch...)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	last := -1
+	for _, key := range keys {
+		if len(key) != len("key_100") {
+			continue
+		}
+		var i int
+		if _, err = fmt.Sscanf(string(key), "key_%d", &i); err != nil {
+			t.Fatal(err)
+		}
+		if i < last {
+			t.Fatalf("expect lru order kept, %s after key_%d", key, last)
+		}
+		last = i
+	}
+}
+
+func TestCacheLRUBatches(t *testing.T) {
+	c, err := NewCache(16*MB, &Config{MemoryType: GO, Shards: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	const n = 100
+	for i := 0; i < n; i++ {
+		if err = c.Set([]byte(fmt.Sprintf("key_%03d", i)), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ca := c.(*cache)
+	shr := ca.shards.shard(ca.allocator, 0)
+
+	// fn在释放锁之后调用, 可以访问cache. 每一批之后访问上一批最后一个key, 删除下一个还没遍历的key
+	seen := make(map[string]int)
+	deleted := make(map[string]bool)
+	batches := 0
+	if err = shr.lruBatches(ca.allocator, 7, func(keys [][]byte) error {
+		batches++
+		if len(keys) > 7 {
+			t.Fatalf("expect at most 7 keys in a batch, got: %d", len(keys))
+		}
+		for _, key := range keys {
+			seen[string(key)]++
+		}
+		if _, err := c.Get(keys[len(keys)-1]); err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			key := fmt.Sprintf("key_%03d", i)
+			if _, ok := seen[key]; !ok && !deleted[key] {
+				deleted[key] = true
+				return c.Delete([]byte(key))
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if batches < n/7/2 {
+		t.Fatalf("expect walked in batches, got: %d", batches)
+	}
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key_%03d", i)
+		if deleted[key] {
+			continue
+		}
+		if seen[key] != 1 {
+			t.Fatalf("expect %s walked once, got: %d", key, seen[key])
+		}
+	}
+}
+
+func TestCacheCloseTimeout(t *testing.T) {
+	timeout := closeTimeout
+	closeTimeout = 50 * time.Millisecond
+	defer func() { closeTimeout = timeout }()
+
+	key := filepath.Join(t.TempDir(), "close")
+	config := &Config{MemoryType: MMAP, MemoryKey: key, Shards: 4}
+	c1, err := NewCache(16*MB, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := NewCache(16*MB, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	meta := c2.(*cache).allocator.metadata
+
+	if err = c1.Set([]byte("k"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	// 一个一直没有结束的操作
+	release := make(chan struct{})
+	entered := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = c1.View([]byte("k"), func([]byte) error {
+			close(entered)
+			<-release
+			return nil
+		})
+	}()
+	<-entered
+	if err = c1.Close(); !errors.Is(err, ErrCloseTimeout) {
+		t.Fatalf("expect ErrCloseTimeout, got: %v", err)
+	}
+	// 超时也马上离开注册表
+	if refs := atomic.LoadInt32(&meta.Refs); refs != 1 {
+		t.Fatalf("expect refs 1 after close timeout, got: %d", refs)
+	}
+	if live := meta.Procs.live(); live != 1 {
+		t.Fatalf("expect one live process, got: %d", live)
+	}
+
+	// 操作结束之后在后台解除映射
+	close(release)
+	<-done
+	if v, err := c2.Get([]byte("k")); err != nil || string(v) != "v" {
+		t.Fatalf("expect k, got: %s, %v", v, err)
+	}
+}
+
+func TestCacheGrowMlock(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("VmLck only on linux")
+	}
+	vmLck := func() uint64 {
+		b, err := os.ReadFile("/proc/self/status")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(string(b), "\n") {
+			var kb uint64
+			if _, err := fmt.Sscanf(line, "VmLck: %d kB", &kb); err == nil {
+				return kb * KB
+			}
+		}
+		t.Fatal("no VmLck in /proc/self/status")
+		return 0
+	}
+
+	key := filepath.Join(t.TempDir(), "grow")
+	config := &Config{MemoryType: MMAP, MemoryKey: key, Shards: 2, MaxMemorySize: 64 * MB, Prefault: true, Mlock: true}
+	c, err := NewCache(16*MB, config)
+	if err != nil {
+		t.Skipf("mlock not permitted: %v", err)
+	}
+	defer c.Close()
+	locked := vmLck()
+	value := make([]byte, 2000)
+	for i := 0; c.(*cache).allocator.metadata.Generation == 0; i++ {
+		if err = c.Set([]byte(fmt.Sprintf("key_%d", i)), value); err != nil {
+			t.Skipf("grown region can not be locked: %v", err)
+		}
+	}
+	// 扩容新增的部分同样锁住
+	grown := c.(*cache).allocator.mem.Size() - 16*MB
+	if after := vmLck(); after < locked+grown {
+		t.Fatalf("expect grown %d bytes locked, VmLck %d -> %d", grown, locked, after)
+	}
+}
+
+func TestCacheGrow(t *testing.T) {
+	key := filepath.Join(t.TempDir(), "grow")
+	config := &Config{MemoryType: MMAP, MemoryKey: key, Shards: 2, MaxElementLen: 100000, MaxMemorySize: 64 * MB}
+	c1, err := NewCache(16*MB, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	c2, err := NewCache(16*MB, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+
+	value := make([]byte, 2000)
+	n := 8000
+	for i := 0; i < n; i++ {
+		if err = c1.Set([]byte(fmt.Sprintf("key_%d", i)), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	meta := c1.(*cache).allocator.metadata
+	if meta.TotalSize <= 16*MB || meta.Generation == 0 {
+		t.Fatalf("expect segment grown, total size: %d, generation: %d", meta.TotalSize, meta.Generation)
+	}
+	if info, err := os.Stat(key); err != nil || uint64(info.Size()) != meta.TotalSize {
+		t.Fatalf("expect file grown to %d, got: %v, %v", meta.TotalSize, info, err)
+	}
+
+	// 另一个进程发现扩容之后重新映射
+	for i := 0; i < n; i++ {
+		if !c2.Has([]byte(fmt.Sprintf("key_%d", i))) {
+			t.Fatalf("expect key_%d visible after remap", i)
+		}
+	}
+	if size := c2.(*cache).allocator.mem.Size(); size != meta.TotalSize {
+		t.Fatalf("expect remapped to %d, got: %d", meta.TotalSize, size)
+	}
+
+	// 超过最大大小之后按LRU淘汰
+	for i := n; i < 3*n; i++ {
+		if err = c2.Set([]byte(fmt.Sprintf("key_%d", i)), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if meta.TotalSize != 64*MB {
+		t.Fatalf("expect grown to max size, got: %d", meta.TotalSize)
+	}
+}
+
+func TestCacheMemfd(t *testing.T) {
+	c1, err := NewCache(16*MB, &Config{MemoryType: MEMFD})
+	if errors.Is(err, ErrNotSupported) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	if err = c1.Set([]byte("k1"), []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 模拟通过unix socket把fd发送给另一个进程
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: filepath.Join(t.TempDir(), "sock"), Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	sender, err := net.DialUnix("unix", nil, ln.Addr().(*net.UnixAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	receiver, err := ln.AcceptUnix()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+	conns := []*net.UnixConn{sender, receiver}
+	if err = SendMemoryFd(conns[0], c1); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := ReceiveMemoryFd(conns[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c2, err := NewCache(16*MB, &Config{MemoryType: MEMFD, MemoryFd: fd})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	if v, err := c2.Get([]byte("k1")); err != nil || string(v) != "v1" {
+		t.Fatalf("expect v1 through the received fd, got: %s, %v", v, err)
+	}
+	if err = c2.Set([]byte("k2"), []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+	if !c1.Has([]byte("k2")) {
+		t.Fatal("expect k2 visible to the sender")
+	}
+}
+
+func TestCacheHugePage(t *testing.T) {
+	// 临时目录不在hugetlbfs上, 退化为透明大页
+	key := filepath.Join(t.TempDir(), "hugepage")
+	c, err := NewCache(15*MB, &Config{MemoryType: HUGEPAGE, MemoryKey: key})
+	if errors.Is(err, ErrNotSupported) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := c.(*cache).allocator.mem.Size(); size%(2*MB) != 0 {
+		t.Fatalf("expect size aligned to huge page, got: %d", size)
+	}
+	if err = c.Set([]byte("k1"), []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(key); !os.IsNotExist(err) {
+		t.Fatalf("expect file removed, got: %v", err)
+	}
+}
+
+func TestCachePrefaultMlock(t *testing.T) {
+	c, err := NewCache(16*MB, &Config{MemoryType: GO, Prefault: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Set([]byte("k1"), []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = NewCache(16*MB, &Config{MemoryType: MMAP, MemoryKey: filepath.Join(t.TempDir(), "mlock"), Prefault: true, Mlock: true})
+	if err != nil {
+		// RLIMIT_MEMLOCK不够或者平台不支持
+		t.Skip(err)
+	}
+	defer c.Close()
+	if err = c.Set([]byte("k1"), []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCacheView(t *testing.T) {
+	key := filepath.Join(t.TempDir(), "view")
+	c, err := NewCache(16*MB, &Config{MemoryType: MMAP, MemoryKey: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err = c.Set([]byte("k1"), []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []byte
+	if err = c.View([]byte("k1"), func(value []byte) error {
+		got = append(got, value...)
+		return nil
+	}); err != nil || string(got) != "v1" {
+		t.Fatalf("expect v1, got: %s, err: %v", got, err)
+	}
+	errStop := errors.New("stop")
+	if err = c.View([]byte("k1"), func(value []byte) error { return errStop }); !errors.Is(err, errStop) {
+		t.Fatalf("expect fn error returned, got: %v", err)
+	}
+	if err = c.View([]byte("k2"), func(value []byte) error { return nil }); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expect ErrNotFound, got: %v", err)
+	}
+	// View持有分片锁, fn返回之后其他操作可以继续
+	if err = c.Set([]byte("k1"), []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := NewCache(16*MB, &Config{MemoryType: MMAP, MemoryKey: key, ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	got = got[:0]
+	if err = reader.View([]byte("k1"), func(value []byte) error {
+		got = append(got, value...)
+		return nil
+	}); err != nil || string(got) != "v2" {
+		t.Fatalf("expect v2 from read only view, got: %s, err: %v", got, err)
+	}
+}
+
+func TestCacheGetAppend(t *testing.T) {
+	c, err := NewCache(16*MB, &Config{MemoryType: GO})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	sc := c.(StringKeyCache)
+	if err = sc.SetStringKey("k1", []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := []byte("prefix-")
+	dst, err = c.GetAppend(dst, []byte("k1"))
+	if err != nil || string(dst) != "prefix-v1" {
+		t.Fatalf("expect prefix-v1, got: %s, err: %v", dst, err)
+	}
+	dst, err = sc.PeekStringKeyAppend(dst[:0], "k1")
+	if err != nil || string(dst) != "v1" {
+		t.Fatalf("expect v1, got: %s, err: %v", dst, err)
+	}
+	dst, err = sc.GetStringKeyAppend(dst, "k2")
+	if !errors.Is(err, ErrNotFound) || string(dst) != "v1" {
+		t.Fatalf("expect ErrNotFound and dst unchanged, got: %s, err: %v", dst, err)
+	}
+
+	// dst容量足够时不分配内存
+	allocs := testing.AllocsPerRun(100, func() {
+		dst, _ = sc.GetStringKeyAppend(dst[:0], "k1")
+		dst, _ = sc.PeekStringKeyAppend(dst[:0], "k1")
+	})
+	if allocs != 0 {
+		t.Fatalf("expect zero allocations, got: %v", allocs)
+	}
+}
+
+func TestCacheMulti(t *testing.T) {
+	c, err := NewCache(16*MB, &Config{MemoryType: GO, Shards: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	keys := make([][]byte, 100)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key_%d", i))
+	}
+	errs, err := c.SetMulti(keys[:50], keys[:50])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("set %s: %v", keys[i], err)
+		}
+	}
+	if _, err = c.SetMulti(keys, keys[:1]); !errors.Is(err, ErrLengthMismatch) {
+		t.Fatal("expect length mismatch error")
+	}
+
+	has := c.HasMulti(keys)
+	values, err := c.GetMulti(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range keys {
+		if i < 50 {
+			if !has[i] || string(values[i]) != string(keys[i]) {
+				t.Fatalf("expect %s exists, got: %v, %s", keys[i], has[i], values[i])
+			}
+		} else if has[i] || values[i] != nil {
+			t.Fatalf("expect %s not exists", keys[i])
+		}
+	}
+
+	errs, err = c.DeleteMulti(keys[40:60])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, err := range errs {
+		if i < 10 && err != nil {
+			t.Fatalf("delete %s: %v", keys[40+i], err)
+		}
+		if i >= 10 && !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expect ErrNotFound for %s, got: %v", keys[40+i], err)
+		}
+	}
+	if c.Has(keys[40]) || !c.Has(keys[39]) {
+		t.Fatal("expect only deleted keys removed")
+	}
+}
+
+func TestCacheConditional(t *testing.T) {
+	c, err := NewCache(16*MB, &Config{MemoryType: GO})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	key := []byte("k1")
+	if err = c.Replace(key, []byte("v0")); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expect ErrNotFound, got: %v", err)
+	}
+	if err = c.Add(key, []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Add(key, []byte("v2")); !errors.Is(err, ErrKeyExists) {
+		t.Fatalf("expect ErrKeyExists, got: %v", err)
+	}
+	if ok, err := c.SetNX(key, []byte("v2")); ok || err != nil {
+		t.Fatalf("expect SetNX not set, got: %v, %v", ok, err)
+	}
+	if err = c.Replace(key, []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+
+	v, version, err := c.GetWithVersion(key)
+	if err != nil || string(v) != "v2" {
+		t.Fatalf("expect v2, got: %s, %v", v, err)
+	}
+	next, err := c.CompareAndSwap(key, []byte("v3"), version)
+	if err != nil || next == version {
+		t.Fatalf("expect swapped with a new version, got: %d, %v", next, err)
+	}
+	if _, err = c.CompareAndSwap(key, []byte("v4"), version); !errors.Is(err, ErrVersionMismatch) {
+		t.Fatalf("expect ErrVersionMismatch, got: %v", err)
+	}
+	// 删除之后重新写入也不会复用版本号
+	if err = c.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.CompareAndSwap(key, []byte("v4"), next); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expect ErrNotFound, got: %v", err)
+	}
+	if err = c.Set(key, []byte("v4")); err != nil {
+		t.Fatal(err)
+	}
+	if _, version, _ = c.GetWithVersion(key); version == next {
+		t.Fatal("expect version not reused")
+	}
+
+	// 并发的Add只有一个成功
+	var wg sync.WaitGroup
+	var added int32
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ok, _ := c.SetNX([]byte("race"), []byte("v")); ok {
+				atomic.AddInt32(&added, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if added != 1 {
+		t.Fatalf("expect exactly one SetNX succeed, got: %d", added)
+	}
+}
+
+func TestCacheUpdate(t *testing.T) {
+	c, err := NewCache(16*MB, &Config{MemoryType: GO})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	key := []byte("counter")
+	incr := func(old []byte, exists bool) ([]byte, Op) {
+		var n int
+		if exists {
+			n, _ = strconv.Atoi(string(old))
+		}
+		return []byte(strconv.Itoa(n + 1)), OpSet
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if err := c.Update(key, incr); err != nil {
+					panic(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if v, err := c.Get(key); err != nil || string(v) != "800" {
+		t.Fatalf("expect 800, got: %s, %v", v, err)
+	}
+
+	// 原地修改old之后返回
+	if err = c.Update(key, func(old []byte, exists bool) ([]byte, Op) {
+		old[0] = '9'
+		return old, OpSet
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := c.Get(key); string(v) != "900" {
+		t.Fatalf("expect 900, got: %s", v)
+	}
+	// 超过原来的大小分类, 换一个节点
+	large := bytes.Repeat([]byte("x"), 4096)
+	if err = c.Update(key, func(old []byte, exists bool) ([]byte, Op) {
+		return append(old, large...), OpSet
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := c.Get(key); len(v) != 3+len(large) || string(v[:3]) != "900" {
+		t.Fatalf("expect value grown, got len: %d", len(v))
+	}
+
+	if err = c.Update(key, func(old []byte, exists bool) ([]byte, Op) { return nil, OpKeep }); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Update(key, func(old []byte, exists bool) ([]byte, Op) { return nil, OpDelete }); err != nil {
+		t.Fatal(err)
+	}
+	if c.Has(key) {
+		t.Fatal("expect key deleted")
+	}
+}
+
+func TestCacheCounter(t *testing.T) {
+	c, err := NewCache(16*MB, &Config{MemoryType: GO})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	key := []byte("counter")
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if _, err := c.Incr(key, 2); err != nil {
+					panic(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if n, err := c.Decr(key, 600); err != nil || n != 1000 {
+		t.Fatalf("expect 1000, got: %d, %v", n, err)
+	}
+	if v, err := c.Get(key); err != nil || len(v) != 8 {
+		t.Fatalf("expect 8 bytes counter, got: %v, %v", v, err)
+	}
+	if err = c.Set([]byte("k1"), []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Incr([]byte("k1"), 1); !errors.Is(err, ErrNotCounter) {
+		t.Fatalf("expect ErrNotCounter, got: %v", err)
+	}
+
+	window := []byte("window")
+	if n, err := c.IncrWithTTL(window, 1, 50*time.Millisecond); err != nil || n != 1 {
+		t.Fatalf("expect 1, got: %d, %v", n, err)
+	}
+	// 已经存在的计数器保留原来的过期时间
+	if n, err := c.IncrWithTTL(window, 1, time.Hour); err != nil || n != 2 {
+		t.Fatalf("expect 2, got: %d, %v", n, err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if c.Has(window) {
+		t.Fatal("expect counter expired")
+	}
+	if n, err := c.Incr(window, 1); err != nil || n != 1 {
+		t.Fatalf("expect expired counter restart from 0, got: %d, %v", n, err)
+	}
+}
+
+func TestCacheAppendSetRange(t *testing.T) {
+	c, err := NewCache(16*MB, &Config{MemoryType: GO})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	key := []byte("log")
+	var expect []byte
+	for i := 0; i < 200; i++ {
+		line := []byte(fmt.Sprintf("line %d\n", i))
+		if err = c.Append(key, line); err != nil {
+			t.Fatal(err)
+		}
+		expect = append(expect, line...)
+	}
+	if v, err := c.Get(key); err != nil || !bytes.Equal(v, expect) {
+		t.Fatalf("expect appended value, got len: %d, %v", len(v), err)
+	}
+
+	if err = c.SetRange(key, 0, []byte("LINE")); err != nil {
+		t.Fatal(err)
+	}
+	copy(expect, "LINE")
+	if v, _ := c.Get(key); !bytes.Equal(v, expect) {
+		t.Fatal("expect value overwritten from offset 0")
+	}
+
+	// 超过末尾时中间补0, 原地修改的节点里残留的旧数据也要清掉
+	if err = c.Set([]byte("k1"), []byte("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Set([]byte("k1"), []byte("ab")); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.SetRange([]byte("k1"), 4, []byte("cd")); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := c.Get([]byte("k1")); string(v) != "ab\x00\x00cd" {
+		t.Fatalf("expect zero filled gap, got: %q", v)
+	}
+	if err = c.SetRange([]byte("k2"), 2, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := c.Get([]byte("k2")); string(v) != "\x00\x00x" {
+		t.Fatalf("expect new key zero filled, got: %q", v)
+	}
+}
+
+func TestCacheSetRangeOverflow(t *testing.T) {
+	c, err := NewCache(32*MB, &Config{MemoryType: GO, Shards: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err = c.Set([]byte("k"), []byte("ab")); err != nil {
+		t.Fatal(err)
+	}
+	// offset+len在uint32下会回绕成很小的元素大小
+	if err = c.SetRange([]byte("k"), 1<<32-20, []byte("x")); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("expect ErrValueTooLarge, got: %v", err)
+	}
+	if err = c.SetRange([]byte("k"), maxNodeSize, []byte("x")); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("expect ErrValueTooLarge, got: %v", err)
+	}
+	if err = c.SetRange([]byte("missing"), 1<<32-20, []byte("x")); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("expect ErrValueTooLarge, got: %v", err)
+	}
+	if err = c.SetRange([]byte("k"), -1, []byte("x")); !errors.Is(err, ErrNegativeOffset) {
+		t.Fatalf("expect ErrNegativeOffset, got: %v", err)
+	}
+	if v, _ := c.Get([]byte("k")); string(v) != "ab" {
+		t.Fatalf("expect value unchanged, got: %q", v)
+	}
+	if c.Has([]byte("missing")) {
+		t.Fatal("expect missing key not created")
+	}
+}
+
+func TestCacheStream(t *testing.T) {
+	c, err := NewCache(32*MB, &Config{MemoryType: GO, Shards: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	key := []byte("file")
+	value := bytes.Repeat([]byte("0123456789abcdef"), 256*1024)
+	if err = c.SetFromReader(key, bytes.NewReader(value), int64(len(value))); err != nil {
+		t.Fatal(err)
+	}
+	r, err := c.GetReader(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err = io.Copy(&buf, r); err != nil || !bytes.Equal(buf.Bytes(), value) {
+		t.Fatalf("expect streamed value, got len: %d, %v", buf.Len(), err)
+	}
+	r.Close()
+
+	// reader返回的数据不够时保留原来的值
+	if err = c.SetFromReader(key, bytes.NewReader(value[:10]), int64(len(value))); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expect io.ErrUnexpectedEOF, got: %v", err)
+	}
+	if v, err := c.Get(key); err != nil || !bytes.Equal(v, value) {
+		t.Fatalf("expect old value kept, got len: %d, %v", len(v), err)
+	}
+
+	// 读取过程中被修改
+	if r, err = c.GetReader(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.Read(make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Set(key, []byte("small")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.Read(make([]byte, 1024)); !errors.Is(err, ErrVersionMismatch) {
+		t.Fatalf("expect ErrVersionMismatch, got: %v", err)
+	}
+	if _, err = c.GetReader([]byte("missing")); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expect ErrNotFound, got: %v", err)
+	}
+}
+
+func TestCacheStreamUnlockedRead(t *testing.T) {
+	c, err := NewCache(32*MB, &Config{MemoryType: GO, Shards: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err = c.Set([]byte("file"), []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- c.SetFromReader([]byte("file"), pr, 6)
+	}()
+	if _, err = pw.Write([]byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	// 等待reader的过程中不持有分片锁, 同一个分片的读写不会被阻塞, 也看不到写了一半的值
+	if err = c.Set([]byte("other"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := c.Get([]byte("file")); string(v) != "old" {
+		t.Fatalf("expect old value during read, got: %q", v)
+	}
+	if _, err = pw.Write([]byte("val")); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := c.Get([]byte("file")); string(v) != "newval" {
+		t.Fatalf("expect newval, got: %q", v)
+	}
+}
+
+func TestCacheStreamSizeOverflow(t *testing.T) {
+	c, err := NewCache(32*MB, &Config{MemoryType: GO, Shards: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// 加上元素头之后在uint32下会回绕
+	if err = c.SetFromReader([]byte("file"), bytes.NewReader(nil), 1<<32-10); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("expect ErrValueTooLarge, got: %v", err)
+	}
+	if err = c.SetFromReader([]byte("file"), bytes.NewReader(nil), -1); !errors.Is(err, ErrInvalidSize) {
+		t.Fatalf("expect ErrInvalidSize, got: %v", err)
+	}
+}
+
+func TestCacheTransaction(t *testing.T) {
+	c, err := NewCache(16*MB, &Config{MemoryType: GO, Shards: 16, HashTags: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ca := c.(*cache)
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("{user:1}:field_%d", i))
+		if ca.shardIndex(xxHashBytes(key), key) != ca.shardIndex(0, []byte("{user:1}")) {
+			t.Fatalf("expect %s in the shard of its tag", key)
+		}
+	}
+	if hashTag([]byte("{}key")) != nil || string(hashTag([]byte("a{b}{c}"))) != "b" {
+		t.Fatal("unexpected hash tag")
+	}
+
+	profile, index := []byte("{user:1}:profile"), []byte("{user:1}:email:a@example.com")
+	if err = c.Transaction([][]byte{profile, index}, func(tx *Tx) error {
+		if _, err := tx.Get(profile); !errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("expect ErrNotFound, got: %v", err)
+		}
+		if err := tx.Set(profile, []byte("a@example.com")); err != nil {
+			return err
+		}
+		if v, err := tx.Get(profile); err != nil || string(v) != "a@example.com" {
+			return fmt.Errorf("expect own write visible, got: %s, %v", v, err)
+		}
+		return tx.Set(index, profile)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !c.Has(profile) || !c.Has(index) {
+		t.Fatal("expect transaction committed")
+	}
+
+	// 回调返回错误时不会写入
+	errAbort := errors.New("abort")
+	if err = c.Transaction([][]byte{profile}, func(tx *Tx) error {
+		if err := tx.Delete(index); err != nil {
+			return err
+		}
+		return errAbort
+	}); !errors.Is(err, errAbort) {
+		t.Fatalf("expect abort error, got: %v", err)
+	}
+	if !c.Has(index) {
+		t.Fatal("expect aborted delete discarded")
+	}
+
+	other := []byte("{user:2}:profile")
+	for i := 2; ca.shardIndex(xxHashBytes(other), other) == ca.shardIndex(xxHashBytes(profile), profile); i++ {
+		other = []byte(fmt.Sprintf("{user:%d}:profile", i))
+	}
+	if err = c.Transaction([][]byte{profile, other}, func(tx *Tx) error { return nil }); !errors.Is(err, ErrCrossShard) {
+		t.Fatalf("expect ErrCrossShard, got: %v", err)
+	}
+	if err = c.Transaction([][]byte{profile}, func(tx *Tx) error { return tx.Set(other, nil) }); !errors.Is(err, ErrCrossShard) {
+		t.Fatalf("expect ErrCrossShard inside transaction, got: %v", err)
+	}
+}
+
+func TestCacheTransactionNoSpace(t *testing.T) {
+	c, err := NewCache(16*MB, &Config{MemoryType: GO, Shards: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ca := c.(*cache)
+	value := bytes.Repeat([]byte("v"), 600)
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key_%d", i)) }
+	// 写满到第一次淘汰, 这时free list中没有空闲的节点, LRU尾部依次是key_1, key_2
+	n := 0
+	for ; n == 0 || c.Has(key(0)); n++ {
+		if err = c.Set(key(n), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	version := func(k []byte) uint64 {
+		hash := xxHashBytes(k)
+		_, node := ca.shard(hash, k).hashmap(ca.allocator).find(ca.allocator, hash, k)
+		if node == nil {
+			t.Fatalf("expect %s exists", k)
+		}
+		return nodeTo[hashmapBucketElement](node).version
+	}
+	v1, v2 := version(key(1)), version(key(2))
+
+	// 第一个新key淘汰key_1, 第二个新key只能淘汰事务中的key_2, 预留失败
+	err = c.Transaction([][]byte{key(2)}, func(tx *Tx) error {
+		_ = tx.Set(key(2), []byte("small"))
+		_ = tx.Set([]byte("new_1"), value)
+		return tx.Set([]byte("new_2"), value)
+	})
+	if !errors.Is(err, ErrNoSpace) {
+		t.Fatalf("expect ErrNoSpace, got: %v", err)
+	}
+	if c.Has([]byte("new_1")) || c.Has([]byte("new_2")) {
+		t.Fatal("expect reserved keys released")
+	}
+	// 淘汰的key放回, 版本号不变, 之前拿到的CAS token仍然有效
+	if version(key(1)) != v1 || version(key(2)) != v2 {
+		t.Fatal("expect versions unchanged by the failed transaction")
+	}
+	if v, _ := c.Get(key(2)); !bytes.Equal(v, value) {
+		t.Fatal("expect key_2 unchanged")
+	}
+	if _, err = c.CompareAndSwap(key(1), value, v1); err != nil {
+		t.Fatalf("expect CAS with the old token, got: %v", err)
+	}
+	for i := 3; i < n; i++ {
+		if !c.Has(key(i)) {
+			t.Fatalf("expect %s not evicted", key(i))
+		}
+	}
+}
+
+func TestCacheMultiTransaction(t *testing.T) {
+	c, err := NewCache(16*MB, &Config{MemoryType: GO, Shards: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	keys := make([][]byte, 8)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("account_%d", i))
+		if _, err = c.Incr(keys[i], 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 不同的goroutine以不同的顺序传入key, 分片按下标排序加锁不会死锁
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				from, to := keys[(g+j)%len(keys)], keys[(g+j*3+1)%len(keys)]
+				err := c.MultiTransaction([][]byte{to, from}, func(tx *Tx) error {
+					a, err := tx.Get(from)
+					if err != nil {
+						return err
+					}
+					b, err := tx.Get(to)
+					if err != nil {
+						return err
+					}
+					if string(from) == string(to) {
+						return nil
+					}
+					_ = tx.Set(from, binary.BigEndian.AppendUint64(nil, binary.BigEndian.Uint64(a)-1))
+					return tx.Set(to, binary.BigEndian.AppendUint64(nil, binary.BigEndian.Uint64(b)+1))
+				})
+				if err != nil {
+					panic(err)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	var sum int64
+	for _, key := range keys {
+		n, err := c.Incr(key, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum += n
+	}
+	if sum != 800 {
+		t.Fatalf("expect total 800, got: %d", sum)
+	}
+
+	// 中途写入失败时回滚已经写入的部分
+	if err = c.Set([]byte("k1"), []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Set([]byte("k2"), []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+	// 超过最大的大小分类, 写入一定失败
+	huge := make([]byte, 32*MB)
+	err = c.MultiTransaction([][]byte{[]byte("k1"), []byte("k2"), []byte("k3")}, func(tx *Tx) error {
+		_ = tx.Set([]byte("k1"), bytes.Repeat([]byte("x"), 1000))
+		_ = tx.Delete([]byte("k2"))
+		_ = tx.Set([]byte("k3"), []byte("v3"))
+		return tx.Set([]byte("k1"), huge)
+	})
+	if err == nil {
+		t.Fatal("expect transaction failed")
+	}
+	if v, _ := c.Get([]byte("k1")); string(v) != "v1" {
+		t.Fatalf("expect k1 rolled back, got len: %d", len(v))
+	}
+	if v, _ := c.Get([]byte("k2")); string(v) != "v2" {
+		t.Fatalf("expect k2 rolled back, got: %s", v)
+	}
+	if c.Has([]byte("k3")) {
+		t.Fatal("expect k3 rolled back")
+	}
+}
@@ -0,0 +1,81 @@
+// Command fastcache-fsck checks the integrity of a SHM or MMAP backed cache segment.
+//
+// The shards, element sizes and the size of a grown MMAP file are read from the segment, so a durable, WAL, growable
+// or big data segment can be checked with the same flags. -size must not exceed the size the segment was created with,
+// and -hash-tags must match Config.HashTags:
+//
+//	fastcache-fsck -type mmap -key /dev/shm/cache -size 1024
+//
+// Without -repair the segment is attached read only, with -repair corrupted shards are reset. The segment is never
+// created, and no heartbeat, leader election or checkpoint runs while it is attached.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/leslie-fei/fastcache"
+)
+
+func main() {
+	var (
+		memoryType string
+		memoryKey  string
+		sizeMB     int
+		repair     bool
+		hashTags   bool
+	)
+	flag.StringVar(&memoryType, "type", "shm", "memory type: shm or mmap")
+	flag.StringVar(&memoryKey, "key", "", "shm memory key or mmap file path")
+	flag.IntVar(&sizeMB, "size", 1024, "memory size in MB the segment was created with")
+	flag.BoolVar(&repair, "repair", false, "reset corrupted shards")
+	flag.BoolVar(&hashTags, "hash-tags", false, "segment created with Config.HashTags")
+	flag.Parse()
+
+	config := &fastcache.Config{
+		MemoryKey:  memoryKey,
+		ReadOnly:   !repair,
+		AttachOnly: repair,
+		HashTags:   hashTags,
+	}
+	switch memoryType {
+	case "shm":
+		config.MemoryType = fastcache.SHM
+	case "mmap":
+		config.MemoryType = fastcache.MMAP
+	default:
+		fmt.Fprintf(os.Stderr, "unknown memory type: %s\n", memoryType)
+		os.Exit(2)
+	}
+
+	cache, err := fastcache.NewCache(sizeMB*fastcache.MB, config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "attach: %v\n", err)
+		os.Exit(2)
+	}
+	defer cache.Close()
+
+	report, err := cache.Verify(repair)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "verify: %v\n", err)
+		os.Exit(2)
+	}
+
+	for _, shr := range report.Corrupted {
+		status := "corrupted"
+		if shr.Repaired {
+			status = "repaired"
+		}
+		fmt.Printf("shard %d: %s\n", shr.Index, status)
+		for _, problem := range shr.Problems {
+			fmt.Printf("  %s\n", problem)
+		}
+	}
+	fmt.Printf("%d shards checked, %d corrupted\n", report.Shards, len(report.Corrupted))
+
+	if len(report.Corrupted) > 0 && !repair {
+		cache.Close()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,155 @@
+package fastcache
+
+import "errors"
+
+// Op tells Update what to do with the value returned by the callback
+type Op uint8
+
+const (
+	// OpKeep leaves the entry unchanged
+	OpKeep Op = iota
+	// OpSet sets the entry to the returned value
+	OpSet
+	// OpDelete deletes the entry
+	OpDelete
+)
+
+// setIf 条件写入的公共部分, check在分片锁内执行, 多个进程之间也是原子的
+func (c *cache) setIf(key []byte, value []byte, check func(el *hashmapBucketElement) error) (uint64, error) {
+	if c.readOnly {
+		return 0, ErrReadOnly
+	}
+	if !c.enter() {
+		return 0, ErrCacheClosed
+	}
+	defer c.exit()
+	hash := xxHashBytes(key)
+	c.counters.add(hash, opSet)
+	shr := c.shard(hash, key)
+	return shr.SetIf(c.allocator, hash, key, value, check)
+}
+
+func checkAbsent(el *hashmapBucketElement) error {
+	if el != nil {
+		return ErrKeyExists
+	}
+	return nil
+}
+
+func checkPresent(el *hashmapBucketElement) error {
+	if el == nil {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (c *cache) Add(key []byte, value []byte) error {
+	_, err := c.setIf(key, value, checkAbsent)
+	return err
+}
+
+func (c *cache) SetNX(key []byte, value []byte) (bool, error) {
+	err := c.Add(key, value)
+	if errors.Is(err, ErrKeyExists) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (c *cache) Replace(key []byte, value []byte) error {
+	_, err := c.setIf(key, value, checkPresent)
+	return err
+}
+
+func (c *cache) CompareAndSwap(key []byte, value []byte, version uint64) (uint64, error) {
+	return c.setIf(key, value, func(el *hashmapBucketElement) error {
+		if el == nil {
+			return ErrNotFound
+		}
+		if el.version != version {
+			return ErrVersionMismatch
+		}
+		return nil
+	})
+}
+
+func (c *cache) GetWithVersion(key []byte) ([]byte, uint64, error) {
+	if !c.enter() {
+		return nil, 0, ErrCacheClosed
+	}
+	defer c.exit()
+	hash := xxHashBytes(key)
+	c.counters.add(hash, opGet)
+	if c.readOnly {
+		return c.peekReadOnlyWithVersion(hash, key)
+	}
+	shr := c.shard(hash, key)
+	return shr.GetWithVersion(c.allocator, hash, key)
+}
+
+// peekReadOnlyWithVersion 只读模式下的GetWithVersion, 不加锁, 不会修改LRU和计数
+func (c *cache) peekReadOnlyWithVersion(hash uint64, key []byte) (value []byte, version uint64, err error) {
+	shr := c.shard(hash, key)
+	shr.optimisticRead(c.allocator, hash, key, func(node *dataNode, el *hashmapBucketElement) {
+		if node == nil {
+			value, version, err = nil, 0, ErrNotFound
+			return
+		}
+		value, version, err = el.value(), el.version, nil
+	})
+	return
+}
+
+func (c *cache) Update(key []byte, fn func(old []byte, exists bool) ([]byte, Op)) error {
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	if !c.enter() {
+		return ErrCacheClosed
+	}
+	defer c.exit()
+	hash := xxHashBytes(key)
+	c.counters.add(hash, opSet)
+	shr := c.shard(hash, key)
+	return shr.Update(c.allocator, hash, key, fn)
+}
+
+// Update 在分片锁内调用fn, old直接指向共享内存, 新值不超过原来的大小分类时由set原地覆盖
+func (s *shard) Update(all *allocator, hash uint64, key []byte, fn func(old []byte, exists bool) ([]byte, Op)) error {
+	s.lock(all)
+	defer s.unlock(all)
+
+	prev, node := s.lookup(all, hash, key)
+	var old []byte
+	if node != nil {
+		old = nodeTo[hashmapBucketElement](node).valueView()
+	}
+	value, op := fn(old, node != nil)
+
+	switch op {
+	case OpSet:
+		s.beginWrite()
+		defer s.endWrite()
+		s.markDirty(undoSet, hash)
+		defer s.clearDirty()
+		// value可能和old是同一块内存, set里面用memmove拷贝, 原来的节点在新值写完之后才释放
+		if _, err := s.set(all, hash, key, value); err != nil {
+			return err
+		}
+		return all.journal(walSet, key, value)
+	case OpDelete:
+		if node == nil {
+			return nil
+		}
+		s.beginWrite()
+		defer s.endWrite()
+		s.markDirty(undoDelete, hash)
+		defer s.clearDirty()
+		if err := s.del(all, hash, prev, node); err != nil {
+			return err
+		}
+		return all.journal(walDelete, key, nil)
+	default:
+		return nil
+	}
+}
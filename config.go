@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"runtime"
+	"time"
 )
 
 type MemoryType int
@@ -12,6 +13,22 @@ const (
 	GO   MemoryType = 1
 	SHM             = 2
 	MMAP            = 3
+	// MEMFD anonymous shared memory from memfd_create, shared by fd inheritance or SCM_RIGHTS, linux only
+	MEMFD = 4
+	// HUGEPAGE file mapping backed by hugetlbfs, or by transparent huge pages when the file is not on hugetlbfs, linux only
+	HUGEPAGE = 5
+)
+
+// WALSyncPolicy when the write-ahead log is fsynced
+type WALSyncPolicy int
+
+const (
+	// WALSyncInterval fsync the log every Config.WALSyncPeriod
+	WALSyncInterval WALSyncPolicy = 1
+	// WALSyncAlways fsync the log on every Set/Delete
+	WALSyncAlways = 2
+	// WALSyncNever leave the flushing to the operating system
+	WALSyncNever = 3
 )
 
 type Config struct {
@@ -19,6 +36,8 @@ type Config struct {
 	MemoryType MemoryType
 	// shard memory key
 	MemoryKey string
+	// MEMFD类型挂载已经存在的memfd, 从父进程继承或者通过ReceiveMemoryFd收到, 0表示新建
+	MemoryFd int `json:"-"`
 	// 支持存储的最大数量, 超过将会触发LRU
 	MaxElementLen uint64
 	// 大数据块的最大数量, 超过这个数量将会触发淘汰, 并且这个数值将会用来初始化大数据块的定长Hashmap
@@ -29,16 +48,60 @@ type Config struct {
 	ShardPerAllocSize uint64
 	// 分片数量
 	Shards uint32
+	// Redis风格的hash tag, key中有{...}时只用第一对花括号之间的部分选择分片, 相关的key在同一个分片中,
+	// 可以一起放到Transaction里修改
+	HashTags bool
 	// hash算法
 	Hasher HashFunc `json:"-"`
+	// 只读方式挂载已经由其他进程初始化好的SHM/MMAP, Set/Delete返回ErrReadOnly, 读取不会修改LRU.
+	// 分片等参数从共享内存读取, 除了HashTags配置不需要和创建时一致, size不能超过创建时的大小
+	ReadOnly bool `json:"-"`
+	// 只挂载已经初始化好的SHM/MMAP, 不会创建或者初始化, 也不从checkpoint恢复和启动心跳, 选主等后台任务.
+	// 给fastcache-fsck -repair这类需要写入但是不能改变共享内存状态的工具使用, 和ReadOnly一样不检查配置是否一致
+	AttachOnly bool `json:"-"`
+	// 进程心跳间隔, 心跳会更新进程注册表并且清理已经退出的进程
+	HeartbeatInterval time.Duration `json:"-"`
+	// 进程心跳超过这个时间没有更新并且确认进程已经不存在才认为已经退出,
+	// 其他pid命名空间的进程没有办法确认, 只按心跳超时判断
+	ProcessTimeout time.Duration `json:"-"`
+	// 主进程租约时长, 主进程退出后最多经过这个时间其他进程就会接管维护任务
+	LeaderLease time.Duration `json:"-"`
+	// 持久化的MMAP, 定期或者调用Checkpoint时把一致的状态msync到文件, 并且拷贝一份到<MemoryKey>.checkpoint,
+	// 启动时文件内容和最后一次checkpoint不一致会从checkpoint文件恢复
+	Durable bool
+	// 主进程定期checkpoint的间隔, 只在Durable时生效
+	CheckpointInterval time.Duration `json:"-"`
+	// 把Set/Delete追加写入<MemoryKey>.wal, 崩溃之后在最后一次checkpoint的基础上重放, 需要Durable
+	WAL bool
+	// WAL的fsync策略
+	WALSync WALSyncPolicy `json:"-"`
+	// WALSyncInterval策略下fsync的间隔
+	WALSyncPeriod time.Duration `json:"-"`
+	// MMAP文件最大可以扩容到的大小, 大于NewCache的size时内存不足会自动扩容, 0表示不扩容
+	MaxMemorySize uint64
+	// NewCache时让整个内存的所有页都映射好, 之后第一次写入不会缺页, 内存越大启动越慢. 扩容新增的部分同样处理
+	Prefault bool `json:"-"`
+	// 锁住整个内存不被换出到swap, 受RLIMIT_MEMLOCK限制, 超过时NewCache返回错误, 扩容时超过限制, 触发扩容的写入返回错误
+	Mlock bool `json:"-"`
+	// GO内存类型的快照文件, Close时写入快照, NewCache时如果存在就从快照恢复
+	SnapshotPath string `json:"-"`
+	// 启动时从快照恢复的时间预算, 超过之后剩下的数据不再恢复
+	RestoreTimeout time.Duration `json:"-"`
 }
 
 func DefaultConfig() *Config {
 	var defaultConfig = &Config{
-		MemoryType:        GO,
-		Shards:            uint32(runtime.NumCPU() * 4),
-		BigDataSize:       16 * KB,
-		ShardPerAllocSize: 1 * MB,
+		MemoryType:         GO,
+		Shards:             uint32(runtime.NumCPU() * 4),
+		BigDataSize:        16 * KB,
+		ShardPerAllocSize:  1 * MB,
+		HeartbeatInterval:  time.Second,
+		ProcessTimeout:     10 * time.Second,
+		LeaderLease:        5 * time.Second,
+		CheckpointInterval: time.Minute,
+		WALSync:            WALSyncInterval,
+		WALSyncPeriod:      100 * time.Millisecond,
+		RestoreTimeout:     5 * time.Second,
 	}
 	return defaultConfig
 }
@@ -51,6 +114,37 @@ func mergeConfig(size int, c *Config) *Config {
 	config.MaxBigDataLen = config.MaxElementLen / 20
 	if c != nil {
 		config.MemoryKey = c.MemoryKey
+		config.MemoryFd = c.MemoryFd
+		config.ReadOnly = c.ReadOnly
+		config.AttachOnly = c.AttachOnly
+		if c.HeartbeatInterval > 0 {
+			config.HeartbeatInterval = c.HeartbeatInterval
+		}
+		if c.ProcessTimeout > 0 {
+			config.ProcessTimeout = c.ProcessTimeout
+		}
+		if c.LeaderLease > 0 {
+			config.LeaderLease = c.LeaderLease
+		}
+		config.Durable = c.Durable
+		if c.CheckpointInterval > 0 {
+			config.CheckpointInterval = c.CheckpointInterval
+		}
+		config.WAL = c.WAL
+		config.HashTags = c.HashTags
+		config.SnapshotPath = c.SnapshotPath
+		config.MaxMemorySize = c.MaxMemorySize
+		config.Prefault = c.Prefault
+		config.Mlock = c.Mlock
+		if c.RestoreTimeout > 0 {
+			config.RestoreTimeout = c.RestoreTimeout
+		}
+		if c.WALSync > 0 {
+			config.WALSync = c.WALSync
+		}
+		if c.WALSyncPeriod > 0 {
+			config.WALSyncPeriod = c.WALSyncPeriod
+		}
 		if c.MemoryType > 0 {
 			config.MemoryType = c.MemoryType
 		}
@@ -0,0 +1,74 @@
+package fastcache
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// counterSize 计数器固定以8字节大端序的int64保存, Get读到的也是这8个字节
+const counterSize = 8
+
+func (c *cache) Incr(key []byte, delta int64) (int64, error) {
+	return c.IncrWithTTL(key, delta, 0)
+}
+
+func (c *cache) Decr(key []byte, delta int64) (int64, error) {
+	return c.IncrWithTTL(key, -delta, 0)
+}
+
+func (c *cache) IncrWithTTL(key []byte, delta int64, ttl time.Duration) (int64, error) {
+	if c.readOnly {
+		return 0, ErrReadOnly
+	}
+	if !c.enter() {
+		return 0, ErrCacheClosed
+	}
+	defer c.exit()
+	hash := xxHashBytes(key)
+	c.counters.add(hash, opSet)
+	shr := c.shard(hash, key)
+	return shr.Incr(c.allocator, hash, key, delta, ttl)
+}
+
+// Incr 计数器存在时在元素内原地修改, 保留原来的过期时间, 不存在或者已经过期时以delta创建, ttl大于0时设置过期时间
+func (s *shard) Incr(all *allocator, hash uint64, key []byte, delta int64, ttl time.Duration) (int64, error) {
+	s.lock(all)
+	defer s.unlock(all)
+
+	_, node := s.lookup(all, hash, key)
+	if node != nil {
+		el := nodeTo[hashmapBucketElement](node)
+		if el.valLen != counterSize {
+			return 0, ErrNotCounter
+		}
+		s.beginWrite()
+		defer s.endWrite()
+		s.markDirty(undoSet, hash)
+		defer s.clearDirty()
+
+		value := el.valueView()
+		n := int64(binary.BigEndian.Uint64(value)) + delta
+		binary.BigEndian.PutUint64(value, uint64(n))
+		s.stamp(el)
+		s.lruStore(all).moveToFront(all, node.freeIndex, el.lruNode())
+		return n, all.journalSet(key, value, el.expireAt)
+	}
+
+	s.beginWrite()
+	defer s.endWrite()
+	s.markDirty(undoSet, hash)
+	defer s.clearDirty()
+
+	var value [counterSize]byte
+	binary.BigEndian.PutUint64(value[:], uint64(delta))
+	node, err := s.set(all, hash, key, value[:])
+	if err != nil {
+		return 0, err
+	}
+	var expireAt int64
+	if ttl > 0 {
+		expireAt = time.Now().Add(ttl).UnixNano()
+	}
+	nodeTo[hashmapBucketElement](node).expireAt = expireAt
+	return delta, all.journalSet(key, value[:], expireAt)
+}
@@ -0,0 +1,325 @@
+package fastcache
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+const (
+	// checkpointSuffix MMAP文件对应的checkpoint文件后缀
+	checkpointSuffix = ".checkpoint"
+	// checkpointMagic checkpoint文件头
+	checkpointMagic = "FCCKPT01"
+	// attachLockSuffix 持久化模式下挂载时加锁的文件后缀
+	attachLockSuffix = ".lock"
+)
+
+var sizeOfCheckpointHeader = unsafe.Sizeof(checkpointHeader{})
+
+// checkpointHeader 保存在metadata中的最后一次checkpoint信息
+type checkpointHeader struct {
+	Generation uint64
+	Checksum   uint64
+	Clean      uint32 // 1表示最后一次checkpoint之后没有任何修改, 文件内容和Checksum一致
+	_          uint32
+	locker     processLocker // 多个进程同时checkpoint时串行执行, 不参与checksum
+}
+
+// markDirty 分片加锁之后调用, 之后的修改会让文件内容和checkpoint不一致
+func (h *checkpointHeader) markDirty() {
+	if atomic.LoadUint32(&h.Clean) == 1 {
+		atomic.StoreUint32(&h.Clean, 0)
+	}
+}
+
+func (h *checkpointHeader) reset() {
+	*h = checkpointHeader{}
+}
+
+func (c *cache) Checkpoint() error {
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	if !c.durable {
+		return ErrNotDurable
+	}
+	if !c.enter() {
+		return ErrCacheClosed
+	}
+	defer c.exit()
+	return c.checkpoint()
+}
+
+// scheduleCheckpoint 注册定期checkpoint的维护任务, 只在主进程执行, 第一次执行在一个间隔之后
+func (c *cache) scheduleCheckpoint(interval time.Duration) {
+	m := &c.maintenance
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.tasks == nil {
+		m.tasks = make(map[string]*maintenanceTask)
+	}
+	name := internalTaskPrefix + "checkpoint"
+	m.tasks[name] = &maintenanceTask{
+		name:     name,
+		interval: interval,
+		fn:       func(ctx context.Context) { _ = c.Checkpoint() },
+		next:     time.Now().Add(interval),
+	}
+}
+
+// checkpoint 把一致的状态拷贝到checkpoint文件, 然后更新metadata中的generation并压缩WAL.
+// 只有拷贝内存和替换WAL时锁住所有分片, fsync和msync都在释放锁之后执行, 不会长时间阻塞写入
+func (c *cache) checkpoint() error {
+	all := c.allocator
+	meta := all.metadata
+	meta.Checkpoint.locker.lock(all)
+	defer meta.Checkpoint.locker.Unlock()
+
+	// 锁住所有分片拷贝内存, 只写到page cache
+	unlock := c.lockAll()
+	generation := meta.Checkpoint.Generation + 1
+	checksum := segmentChecksum(all, c.shards)
+	path := c.memoryKey + checkpointSuffix
+	f, err := createCheckpointFile(path, all, generation, checksum)
+	if err != nil {
+		unlock()
+		return err
+	}
+	// 释放锁之后的修改会清掉Clean
+	meta.Checkpoint.Checksum = checksum
+	atomic.StoreUint32(&meta.Checkpoint.Clean, 1)
+	var keep int64
+	if all.wal != nil {
+		// 之前的记录都已经包含在checkpoint中
+		keep, err = all.wal.size()
+	}
+	unlock()
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	if err = commitCheckpointFile(f, path); err != nil {
+		return err
+	}
+	if err = msync(all.mem); err != nil {
+		return err
+	}
+
+	// 新的checkpoint文件已经落盘, 再切换generation, 同时去掉WAL中已经包含在checkpoint中的记录.
+	// 在这之前崩溃时WAL的generation比checkpoint小一代, 重放时仍然有效
+	unlock = c.lockAll()
+	atomic.StoreUint64(&meta.Checkpoint.Generation, generation)
+	if all.wal != nil {
+		err = all.wal.rewrite(generation, keep)
+	}
+	unlock()
+	if err != nil {
+		return err
+	}
+	return msync(all.mem)
+}
+
+// lockAll 锁住所有分片和全局分配锁, 和Set中的加锁顺序保持一致: 先分片锁再全局分配锁
+func (c *cache) lockAll() (unlock func()) {
+	all := c.allocator
+	for i := 0; i < int(c.shards.Len()); i++ {
+		c.shards.shard(all, i).lock(all)
+	}
+	all.locker.Lock()
+	return func() {
+		all.locker.Unlock()
+		for i := int(c.shards.Len()) - 1; i >= 0; i-- {
+			c.shards.shard(all, i).unlock(all)
+		}
+	}
+}
+
+// segmentChecksum 计算已分配内存的checksum, 跳过所有的进程锁和metadata中运行时的状态
+func segmentChecksum(all *allocator, shrs *shards) uint64 {
+	meta := all.metadata
+	d := xxhash.New()
+	var b []byte
+	for _, v := range []uint64{meta.Magic, meta.Layout, meta.Hash, meta.TotalSize, meta.Used, meta.LockerOffset, meta.ShardArrOffset} {
+		b = binary.LittleEndian.AppendUint64(b, v)
+	}
+	_, _ = d.Write(b)
+
+	lockers := []uint64{meta.LockerOffset}
+	for i := 0; i < int(shrs.Len()); i++ {
+		lockers = append(lockers, shrs.shard(all, i).lockerOffset)
+	}
+	sort.Slice(lockers, func(i, j int) bool { return lockers[i] < lockers[j] })
+
+	pos := uint64(sizeOfMetadata)
+	for _, offset := range append(lockers, meta.Used) {
+		if offset > pos {
+			_, _ = d.Write(unsafe.Slice((*byte)(all.mem.PtrOffset(pos)), offset-pos))
+		}
+		pos = offset + uint64(sizeOfProcessLocker)
+	}
+	return d.Sum64()
+}
+
+// createCheckpointFile 把[0, Used)完整拷贝到临时文件, 调用方需要持有所有的锁.
+// 只写到page cache, 由commitCheckpointFile在释放锁之后fsync并rename
+func createCheckpointFile(path string, all *allocator, generation uint64, checksum uint64) (f *os.File, err error) {
+	tmp := path + ".tmp"
+	f, err = os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+
+	used := all.metadata.Used
+	head := []byte(checkpointMagic)
+	head = binary.LittleEndian.AppendUint64(head, generation)
+	head = binary.LittleEndian.AppendUint64(head, checksum)
+	head = binary.LittleEndian.AppendUint64(head, used)
+	if _, err = f.Write(head); err != nil {
+		return nil, err
+	}
+	if _, err = f.Write(unsafe.Slice((*byte)(all.mem.Ptr()), used)); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// commitCheckpointFile 临时文件落盘之后rename, 保证文件要么是旧的要么是完整的新的
+func commitCheckpointFile(f *os.File, path string) (err error) {
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// restoreCheckpointFile 把checkpoint文件拷贝回内存, 并且校验checksum
+func restoreCheckpointFile(path string, all *allocator) (err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	head := make([]byte, len(checkpointMagic)+24)
+	if _, err = io.ReadFull(f, head); err != nil {
+		return err
+	}
+	if string(head[:len(checkpointMagic)]) != checkpointMagic {
+		return errors.New("bad checkpoint file magic")
+	}
+	head = head[len(checkpointMagic):]
+	generation := binary.LittleEndian.Uint64(head)
+	checksum := binary.LittleEndian.Uint64(head[8:])
+	used := binary.LittleEndian.Uint64(head[16:])
+	if used < uint64(sizeOfMetadata) || used > all.mem.Size() {
+		return fmt.Errorf("checkpoint used size %d out of range", used)
+	}
+	meta := all.metadata
+	defer func() {
+		// 内存已经被覆盖了一部分, 不能再使用
+		if err != nil {
+			meta.reset()
+		}
+	}()
+	if _, err = io.ReadFull(f, unsafe.Slice((*byte)(all.mem.Ptr()), used)); err != nil {
+		return err
+	}
+	if meta.Magic != magic || meta.Used != used {
+		return errors.New("bad checkpoint metadata")
+	}
+	if err = checkLayout(meta); err != nil {
+		return err
+	}
+	shrs := all.shards()
+	if segmentChecksum(all, shrs) != checksum {
+		return errors.New("checkpoint checksum mismatch")
+	}
+
+	// checkpoint中保存的运行时状态已经没有意义
+	meta.Refs = 0
+	meta.Flags &^= metaFlagDestroyPending
+	meta.Procs.reset()
+	meta.Leader.reset()
+	meta.Checkpoint.locker.Reset()
+	(*processLocker)(all.mem.PtrOffset(meta.LockerOffset)).Reset()
+	for i := 0; i < int(shrs.Len()); i++ {
+		shrs.shard(all, i).locker(all).Reset()
+	}
+	meta.Checkpoint.Generation = generation
+	meta.Checkpoint.Checksum = checksum
+	atomic.StoreUint32(&meta.Checkpoint.Clean, 1)
+	return nil
+}
+
+// prepareDurable 第一个挂载的进程校验MMAP文件和最后一次checkpoint一致, 否则从checkpoint文件恢复,
+// 都不满足时拒绝打开. 返回true表示当前进程是第一个挂载的进程, 内存中是最后一次checkpoint的状态.
+// 只会重置或者恢复还没有初始化的文件, 或者以同样的配置持久化创建的文件, 其他文件原样交给后面的检查返回错误
+func prepareDurable(all *allocator, config *Config, confHash uint64) (bool, error) {
+	meta := all.metadata
+	if meta.Magic == magic {
+		if checkLayout(meta) != nil || meta.Hash != confHash || !meta.hasFlag(metaFlagDurable) {
+			// 不持久化或者配置不同的文件不能覆盖, 交给后面的布局和config hash检查返回错误
+			return false, nil
+		}
+		if pruned := meta.Procs.prune(-1, config.ProcessTimeout); pruned > 0 {
+			atomic.AddInt32(&meta.Refs, -int32(pruned))
+		}
+		if meta.Procs.live() > 0 {
+			// 其他进程正在使用, 内容由它们保证
+			return false, nil
+		}
+		if atomic.LoadUint32(&meta.Checkpoint.Clean) == 1 && segmentChecksum(all, all.shards()) == meta.Checkpoint.Checksum {
+			return true, nil
+		}
+	}
+
+	err := restoreCheckpointFile(config.MemoryKey+checkpointSuffix, all)
+	if err == nil {
+		return true, nil
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		// 还没有checkpoint过, 从空的cache开始, 之后的修改只能通过WAL恢复
+		meta.reset()
+		return true, nil
+	}
+	return false, fmt.Errorf("%w: %v", ErrCheckpointInvalid, err)
+}
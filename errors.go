@@ -3,12 +3,31 @@ package fastcache
 import "errors"
 
 var (
-	ErrNoSpace            = errors.New("memory no space")
-	ErrMemorySizeTooSmall = errors.New("memory size too small")
-	ErrNotFound           = errors.New("key not found")
-	ErrIndexOutOfRange    = errors.New("index out of range")
-	ErrFreeListIsEmpty    = errors.New("free list is empty")
-	ErrLRUListIsEmpty     = errors.New("lru list is empty")
-	ErrCacheClosed        = errors.New("cache closed")
-	ErrCloseTimeout       = errors.New("cache close timeout")
+	ErrNoSpace               = errors.New("memory no space")
+	ErrMemorySizeTooSmall    = errors.New("memory size too small")
+	ErrNotFound              = errors.New("key not found")
+	ErrIndexOutOfRange       = errors.New("index out of range")
+	ErrFreeListIsEmpty       = errors.New("free list is empty")
+	ErrLRUListIsEmpty        = errors.New("lru list is empty")
+	ErrCacheClosed           = errors.New("cache closed")
+	ErrCloseTimeout          = errors.New("cache close timeout")
+	ErrIncompatibleSegment   = errors.New("incompatible segment")
+	ErrReadOnly              = errors.New("cache is read only")
+	ErrSegmentNotInitialized = errors.New("segment not initialized")
+	ErrSegmentDestroyed      = errors.New("segment is being destroyed")
+	ErrTooManyProcesses      = errors.New("too many attached processes")
+	ErrNotSupported          = errors.New("not supported on this platform")
+	ErrNotDurable            = errors.New("cache is not durable")
+	ErrCheckpointInvalid     = errors.New("checkpoint invalid")
+	ErrSnapshotInvalid       = errors.New("snapshot invalid")
+	ErrKeyExists             = errors.New("key already exists")
+	ErrVersionMismatch       = errors.New("version mismatch")
+	ErrNotCounter            = errors.New("value is not a counter")
+	ErrCrossShard            = errors.New("keys are in different shards")
+	ErrLengthMismatch        = errors.New("keys and values length mismatch")
+	ErrNegativeOffset        = errors.New("negative offset")
+	ErrValueTooLarge         = errors.New("value too large")
+	ErrInvalidSize           = errors.New("invalid value size")
+	ErrInvalidMaintenance    = errors.New("maintenance task requires a positive interval and a func")
+	ErrReservedTaskName      = errors.New("maintenance task name is reserved")
 )
@@ -7,6 +7,9 @@ import (
 
 var sizeOfFreeStore = unsafe.Sizeof(freeStore{})
 
+// maxNodeSize 最大的大小分类, 更大的元素没有freeList可以分配
+const maxNodeSize = 1 << 24
+
 type freeStore struct {
 	freeLists [25]freeList
 }
@@ -5,9 +5,7 @@ go 1.21
 require (
 	github.com/cespare/xxhash/v2 v2.3.0
 	github.com/leslie-fei/memcore v0.0.0-20240611074219-2f13777e1d72
+	golang.org/x/sys v0.21.0
 )
 
-require (
-	github.com/edsrzf/mmap-go v1.1.0 // indirect
-	golang.org/x/sys v0.21.0 // indirect
-)
+require github.com/edsrzf/mmap-go v1.1.0 // indirect
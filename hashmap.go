@@ -3,6 +3,7 @@ package fastcache
 import (
 	"io"
 	"reflect"
+	"time"
 	"unsafe"
 )
 
@@ -120,17 +121,24 @@ func (l *hashmapBucket) find(all *allocator, hash uint64, key []byte) (prev *dat
 	return nil, nil
 }
 
-// hashmapBucketElement head + lruNode + key + value
+// hashmapBucketElement head + lruNode + key + value.
+// version和expireAt让头部从16字节变成32字节, 元素按2的幂分配, 只有key+value刚好在分类边界附近时才会多占一个分类, 见README
 type hashmapBucketElement struct {
-	keyLen uint32 // key length
-	valLen uint32 // val length
-	hash   uint64
+	keyLen   uint32 // key length
+	valLen   uint32 // val length
+	hash     uint64
+	version  uint64 // 每次写入时从分片的版本号分配, 用于CompareAndSwap
+	expireAt int64  // 过期时间 unix nano, 0表示不过期
 }
 
 func (el *hashmapBucketElement) reset() {
 	*el = hashmapBucketElement{}
 }
 
+func (el *hashmapBucketElement) isExpired() bool {
+	return el.expireAt != 0 && el.expireAt <= time.Now().UnixNano()
+}
+
 func (el *hashmapBucketElement) equal(key []byte) bool {
 	if el.keyLen != uint32(len(key)) {
 		return false
@@ -173,6 +181,21 @@ func (el *hashmapBucketElement) value() []byte {
 	return ss
 }
 
+// valueView 直接指向共享内存中的value, 不拷贝, 只在持有分片锁期间有效
+func (el *hashmapBucketElement) valueView() []byte {
+	var ss []byte
+	sh := (*reflect.SliceHeader)(unsafe.Pointer(&ss))
+	sh.Data = uintptr(el.valPtr())
+	sh.Len = int(el.valLen)
+	// cap和len相同, append时一定会重新分配, 不会写到后面的元素
+	sh.Cap = sh.Len
+	return ss
+}
+
+func (el *hashmapBucketElement) appendValue(dst []byte) []byte {
+	return append(dst, el.valueView()...)
+}
+
 func (el *hashmapBucketElement) lruNode() *listNode {
 	ptr := uintptr(unsafe.Pointer(el)) + sizeOfHashmapBucketElement
 	return (*listNode)(unsafe.Pointer(ptr))
@@ -200,6 +223,16 @@ func (el *hashmapBucketElement) valueWithBuffer(buffer io.Writer) error {
 	return err
 }
 
-func hashmapElementSize(key []byte, value []byte) uint32 {
-	return uint32(sizeOfHashmapBucketElement) + uint32(sizeOfLRUNode) + uint32(len(key)) + uint32(len(value))
+// hashmapElementSize 用uint64计算元素的大小, 很大的value在uint32下会溢出成一个很小的值
+func hashmapElementSize(keyLen, valLen uint64) uint64 {
+	return uint64(sizeOfHashmapBucketElement) + uint64(sizeOfLRUNode) + keyLen + valLen
+}
+
+// hashmapElementIndex 返回元素所在的大小分类, 超过最大的分类时返回ErrValueTooLarge
+func hashmapElementIndex(keyLen, valLen uint64) (uint8, error) {
+	elSize := hashmapElementSize(keyLen, valLen)
+	if elSize > maxNodeSize {
+		return 0, ErrValueTooLarge
+	}
+	return sizeToIndex(uint32(elSize)), nil
 }
@@ -0,0 +1,66 @@
+package fastcache
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// hugetlbfsMagic statfs返回的hugetlbfs文件系统类型
+const hugetlbfsMagic = 0x958458f6
+
+// defaultHugePageSize 不在hugetlbfs上时按2MB对齐, 方便透明大页
+const defaultHugePageSize = 2 * MB
+
+// newHugePageMemory MemoryKey在hugetlbfs挂载目录下时直接使用大页, 否则以普通文件映射之后madvise(MADV_HUGEPAGE),
+// 由透明大页尽量合并, 例如/dev/shm在shmem_enabled为advise时
+func newHugePageMemory(key string, size uint64, readOnly bool) (Memory, error) {
+	return &mappedMemory{
+		attach: func() ([]byte, error) {
+			flag, prot := os.O_RDWR|os.O_CREATE, unix.PROT_READ|unix.PROT_WRITE
+			if readOnly {
+				flag, prot = os.O_RDONLY, unix.PROT_READ
+			}
+			f, err := os.OpenFile(key, flag, 0666)
+			if err != nil {
+				if readOnly && errors.Is(err, os.ErrNotExist) {
+					return nil, ErrSegmentNotInitialized
+				}
+				return nil, err
+			}
+			defer f.Close()
+
+			pageSize, hugetlb := uint64(defaultHugePageSize), false
+			var fs unix.Statfs_t
+			if err = unix.Fstatfs(int(f.Fd()), &fs); err == nil && uint64(fs.Type) == hugetlbfsMagic {
+				pageSize, hugetlb = uint64(fs.Bsize), true
+			}
+			// 映射大小必须是大页的整数倍
+			size = (size + pageSize - 1) &^ (pageSize - 1)
+			st, err := f.Stat()
+			if err != nil {
+				return nil, err
+			}
+			if uint64(st.Size()) < size {
+				if readOnly {
+					return nil, ErrSegmentNotInitialized
+				}
+				if err = f.Truncate(int64(size)); err != nil {
+					return nil, err
+				}
+			}
+
+			data, err := unix.Mmap(int(f.Fd()), 0, int(size), prot, unix.MAP_SHARED)
+			if err != nil {
+				return nil, err
+			}
+			if !hugetlb {
+				// 内核不支持透明大页时忽略, 退化为普通的MMAP
+				_ = unix.Madvise(data, unix.MADV_HUGEPAGE)
+			}
+			return data, nil
+		},
+		detach: unix.Munmap,
+	}, nil
+}
@@ -0,0 +1,121 @@
+package fastcache
+
+import (
+	"encoding/binary"
+	"fmt"
+	"runtime"
+	"unsafe"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// Version of the library, it is part of the segment layout fingerprint
+const Version = "v0.2.0"
+
+// layoutFingerprint 共享内存中所有结构体的布局指纹, 在包初始化时计算一次
+var layoutFingerprint = computeLayoutFingerprint()
+
+// IncompatibleSegmentError returned by NewCache when the segment was created by a binary
+// with a different struct layout, library version, pointer size or endianness.
+type IncompatibleSegmentError struct {
+	Expected uint64
+	Actual   uint64
+}
+
+func (e *IncompatibleSegmentError) Error() string {
+	return fmt.Sprintf("incompatible segment layout: expected fingerprint %#x, got %#x", e.Expected, e.Actual)
+}
+
+func (e *IncompatibleSegmentError) Unwrap() error {
+	return ErrIncompatibleSegment
+}
+
+// checkLayout 校验已经初始化过的共享内存是否和当前二进制的布局一致
+func checkLayout(meta *metadata) error {
+	if meta.Layout != layoutFingerprint {
+		return &IncompatibleSegmentError{Expected: layoutFingerprint, Actual: meta.Layout}
+	}
+	return nil
+}
+
+func computeLayoutFingerprint() uint64 {
+	var b []byte
+	put := func(vs ...uintptr) {
+		for _, v := range vs {
+			b = binary.LittleEndian.AppendUint64(b, uint64(v))
+		}
+	}
+
+	b = append(b, Version...)
+	b = append(b, runtime.GOARCH...)
+	put(unsafe.Sizeof(uintptr(0)), allocAlign)
+	// 字节序
+	x := uint16(1)
+	b = append(b, *(*byte)(unsafe.Pointer(&x)))
+
+	var meta metadata
+	put(unsafe.Sizeof(meta),
+		unsafe.Offsetof(meta.Magic), unsafe.Offsetof(meta.Layout), unsafe.Offsetof(meta.Hash),
+		unsafe.Offsetof(meta.TotalSize), unsafe.Offsetof(meta.Used),
+		unsafe.Offsetof(meta.LockerOffset), unsafe.Offsetof(meta.ShardArrOffset),
+		unsafe.Offsetof(meta.Refs), unsafe.Offsetof(meta.Flags), unsafe.Offsetof(meta.Procs),
+		unsafe.Offsetof(meta.Leader), unsafe.Offsetof(meta.Checkpoint), unsafe.Offsetof(meta.Generation))
+
+	var ckpt checkpointHeader
+	put(sizeOfCheckpointHeader, unsafe.Offsetof(ckpt.Generation), unsafe.Offsetof(ckpt.Checksum), unsafe.Offsetof(ckpt.Clean), unsafe.Offsetof(ckpt.locker))
+
+	var slot procSlot
+	put(sizeOfProcTable, unsafe.Sizeof(slot), unsafe.Offsetof(slot.owner), unsafe.Offsetof(slot.started), unsafe.Offsetof(slot.pidNS),
+		unsafe.Offsetof(slot.attached), unsafe.Offsetof(slot.heartbeat), unsafe.Offsetof(slot.gets),
+		unsafe.Offsetof(slot.sets), unsafe.Offsetof(slot.deletes))
+
+	var lease leaderLease
+	put(sizeOfLeaderLease, unsafe.Offsetof(lease.state), unsafe.Offsetof(lease.expires))
+
+	var locker processLocker
+	put(unsafe.Sizeof(locker), unsafe.Offsetof(locker.write), unsafe.Offsetof(locker.read), unsafe.Offsetof(locker.started))
+
+	var shrs shards
+	put(unsafe.Sizeof(shrs), unsafe.Offsetof(shrs.len), unsafe.Offsetof(shrs.arrOffset))
+
+	var shr shard
+	put(unsafe.Sizeof(shr),
+		unsafe.Offsetof(shr.hashmapOffset), unsafe.Offsetof(shr.lruStoreOffset),
+		unsafe.Offsetof(shr.freeStoreOffset), unsafe.Offsetof(shr.lockerOffset), unsafe.Offsetof(shr.maxLen),
+		unsafe.Offsetof(shr.seq), unsafe.Offsetof(shr.undo), unsafe.Offsetof(shr.version))
+
+	var undo undoRecord
+	put(sizeOfUndoRecord, unsafe.Offsetof(undo.op), unsafe.Offsetof(undo.hash))
+
+	var hm hashmap
+	put(unsafe.Sizeof(hm), unsafe.Offsetof(hm.len), unsafe.Offsetof(hm.bucketLen), unsafe.Offsetof(hm.bucketsOffset))
+
+	var bucket hashmapBucket
+	put(unsafe.Sizeof(bucket), unsafe.Offsetof(bucket.len), unsafe.Offsetof(bucket.linkedFirstOffset))
+
+	var el hashmapBucketElement
+	put(unsafe.Sizeof(el), unsafe.Offsetof(el.keyLen), unsafe.Offsetof(el.valLen), unsafe.Offsetof(el.hash),
+		unsafe.Offsetof(el.version), unsafe.Offsetof(el.expireAt))
+
+	var ln listNode
+	put(unsafe.Sizeof(ln), unsafe.Offsetof(ln.prev), unsafe.Offsetof(ln.next))
+
+	var l list
+	put(unsafe.Sizeof(l), unsafe.Offsetof(l.root), unsafe.Offsetof(l.len))
+
+	var ls lruStore
+	put(unsafe.Sizeof(ls), uintptr(len(ls.lruLists)))
+
+	var node dataNode
+	put(unsafe.Sizeof(node), unsafe.Offsetof(node.next), unsafe.Offsetof(node.freeIndex), unsafe.Offsetof(node.count))
+
+	var fl freeList
+	put(unsafe.Sizeof(fl), unsafe.Offsetof(fl.index), unsafe.Offsetof(fl.len),
+		unsafe.Offsetof(fl.size), unsafe.Offsetof(fl.firstDataNodeOffset))
+
+	var fs freeStore
+	put(unsafe.Sizeof(fs), uintptr(len(fs.freeLists)))
+
+	// 这里不能使用xxHashBytes, 它可能被Config.Hasher替换掉
+	return xxhash.Sum64(b)
+}
@@ -0,0 +1,209 @@
+package fastcache
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+var sizeOfLeaderLease = unsafe.Sizeof(leaderLease{})
+
+// internalTaskPrefix 内部维护任务名字的前缀, RegisterMaintenance不能使用, 避免覆盖内部任务
+const internalTaskPrefix = "fastcache."
+
+// MaintenanceFunc is a background task which only runs on the leader process, ctx is canceled
+// when the process loses the leadership or the cache is closed.
+type MaintenanceFunc func(ctx context.Context)
+
+// leaderLease 保存在metadata中的主进程租约, 所有挂载的进程中只有一个能成为主进程执行后台维护任务
+type leaderLease struct {
+	state   uint64 // epoch<<32 | owner, 换主时CAS整个state, epoch+1, 同一个epoch只会有一个owner. owner为0表示没有主进程
+	expires int64  // 租约过期时间 unix nano, 抢主之前先写入, 其他进程看到新的state时一定也能看到新的过期时间
+}
+
+// leaseOwner 租约中的身份: 注册表中的slot+1放在低8位, slot的注册代数放在高24位, 进程重新注册之后身份会变
+func leaseOwner(slot int, owner uint64) uint32 {
+	return uint32(slot+1) | uint32(owner>>32)<<8
+}
+
+// leaseState 拆分state, 返回epoch和owner
+func leaseState(state uint64) (uint32, uint32) {
+	return uint32(state >> 32), uint32(state)
+}
+
+// leaseOwner 当前进程在租约中的身份
+func (c *cache) leaseOwner() uint32 {
+	c.procMu.Lock()
+	defer c.procMu.Unlock()
+	return leaseOwner(c.slot, c.owner)
+}
+
+// ownerAlive 租约中的进程是否存活: 注册表中对应的slot还是同一次注册, 并且进程没有退出
+func (t *procTable) ownerAlive(owner uint32, timeout time.Duration) bool {
+	index := int(owner&0xff) - 1
+	if index < 0 || index >= len(t.slots) {
+		return false
+	}
+	slot := &t.slots[index]
+	cur := atomic.LoadUint64(&slot.owner)
+	pid := slotPid(cur)
+	if pid == 0 || uint32(cur>>32)&0xffffff != owner>>8 {
+		return false
+	}
+	return !slot.dead(pid, time.Now().UnixNano(), timeout)
+}
+
+// acquire 续约或者尝试成为主进程, myEpoch是上一次成为主进程时的epoch, 成功返回当前的epoch
+func (l *leaderLease) acquire(procs *procTable, owner uint32, myEpoch uint32, lease, timeout time.Duration) (uint32, bool) {
+	now := time.Now().UnixNano()
+	state := atomic.LoadUint64(&l.state)
+	epoch, cur := leaseState(state)
+	if cur == owner && epoch == myEpoch {
+		atomic.StoreInt64(&l.expires, now+int64(lease))
+		// 续约之后再确认一次没有被其他进程抢走
+		return epoch, atomic.LoadUint64(&l.state) == state
+	}
+	if cur != 0 && now < atomic.LoadInt64(&l.expires) && procs.ownerAlive(cur, timeout) {
+		return 0, false
+	}
+	// 租约已经过期或者主进程已经退出, 先写入过期时间再CAS抢主, epoch为0表示不是主进程, 回绕时跳过
+	next := epoch + 1
+	if next == 0 {
+		next = 1
+	}
+	atomic.StoreInt64(&l.expires, now+int64(lease))
+	if !atomic.CompareAndSwapUint64(&l.state, state, uint64(next)<<32|uint64(owner)) {
+		return 0, false
+	}
+	return next, true
+}
+
+// release 主动放弃租约, 其他进程可以马上接管
+func (l *leaderLease) release(owner uint32, myEpoch uint32) {
+	state := uint64(myEpoch)<<32 | uint64(owner)
+	if atomic.CompareAndSwapUint64(&l.state, state, uint64(myEpoch)<<32) {
+		atomic.StoreInt64(&l.expires, 0)
+	}
+}
+
+func (l *leaderLease) reset() {
+	*l = leaderLease{}
+}
+
+type maintenanceTask struct {
+	name     string
+	interval time.Duration
+	fn       MaintenanceFunc
+	next     time.Time
+	running  int32
+}
+
+// maintenance 进程内的主进程状态和维护任务
+type maintenance struct {
+	mu     sync.Mutex
+	tasks  map[string]*maintenanceTask
+	epoch  uint32 // 成为主进程时的epoch, 0表示不是主进程
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (c *cache) IsLeader() bool {
+	return atomic.LoadUint32(&c.maintenance.epoch) != 0
+}
+
+func (c *cache) RegisterMaintenance(name string, interval time.Duration, fn MaintenanceFunc) error {
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	if interval <= 0 || fn == nil {
+		return ErrInvalidMaintenance
+	}
+	if strings.HasPrefix(name, internalTaskPrefix) {
+		return ErrReservedTaskName
+	}
+	m := &c.maintenance
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.tasks == nil {
+		m.tasks = make(map[string]*maintenanceTask)
+	}
+	m.tasks[name] = &maintenanceTask{name: name, interval: interval, fn: fn}
+	return nil
+}
+
+func (c *cache) leaderLoop(lease time.Duration) {
+	defer c.wg.Done()
+	// 租约时间内至少续约两次
+	ticker := time.NewTicker(lease / 3)
+	defer ticker.Stop()
+	c.elect(lease)
+	for {
+		select {
+		case <-c.stop:
+			c.resign()
+			return
+		case <-ticker.C:
+			c.elect(lease)
+		}
+	}
+}
+
+// elect 续约或者抢主, 是主进程时执行到期的维护任务
+func (c *cache) elect(lease time.Duration) {
+	if atomic.LoadUint32(&c.closed) == 1 {
+		// 正在关闭, 不再续约, 由resign放弃
+		return
+	}
+	m := &c.maintenance
+	l := &c.allocator.metadata.Leader
+	owner := c.leaseOwner()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	epoch, ok := l.acquire(&c.allocator.metadata.Procs, owner, m.epoch, lease, c.allocator.procTimeout)
+	if !ok {
+		if m.epoch != 0 {
+			// 失去主进程身份, 取消正在执行的任务
+			m.cancel()
+			atomic.StoreUint32(&m.epoch, 0)
+		}
+		return
+	}
+	if epoch != m.epoch {
+		if m.cancel != nil {
+			m.cancel()
+		}
+		m.ctx, m.cancel = context.WithCancel(context.Background())
+		atomic.StoreUint32(&m.epoch, epoch)
+	}
+
+	now := time.Now()
+	for _, task := range m.tasks {
+		if now.Before(task.next) || !atomic.CompareAndSwapInt32(&task.running, 0, 1) {
+			continue
+		}
+		task.next = now.Add(task.interval)
+		c.wg.Add(1)
+		go func(task *maintenanceTask, ctx context.Context) {
+			defer c.wg.Done()
+			defer atomic.StoreInt32(&task.running, 0)
+			task.fn(ctx)
+		}(task, m.ctx)
+	}
+}
+
+// resign 关闭时放弃主进程身份
+func (c *cache) resign() {
+	m := &c.maintenance
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.epoch == 0 {
+		return
+	}
+	m.cancel()
+	c.allocator.metadata.Leader.release(c.leaseOwner(), m.epoch)
+	atomic.StoreUint32(&m.epoch, 0)
+}
@@ -13,20 +13,54 @@ type Locker interface {
 	sync.Locker
 }
 
+// lockStaleSpins 自旋多少次之后检查一次锁的持有者是否还存活
+const lockStaleSpins = 1 << 12
+
+// holderChecker 判断锁的持有者是否存活, 由allocator结合进程注册表实现
+type holderChecker interface {
+	holderAlive(pid int32, started uint64) bool
+}
+
 type processLocker struct {
-	write int32
-	read  int32
+	write   int32 // 持有锁的进程pid, 0表示未加锁
+	read    int32
+	started uint64 // 持有者的启动时间, 加锁之后写入, 解锁之前清零, 0表示还没写入或者未知
 }
 
 func (l *processLocker) Lock() {
-	// TODO lock timeout
-	for !atomic.CompareAndSwapInt32(&l.write, 0, 1) {
+	l.lock(nil)
+}
+
+// lock 加锁, 一直拿不到锁时通过h判断持有者是否已经退出, h为nil时只能检查本pid命名空间中的进程
+func (l *processLocker) lock(h holderChecker) {
+	for spins := 1; !atomic.CompareAndSwapInt32(&l.write, 0, selfPid); spins++ {
+		if spins%lockStaleSpins == 0 && l.recoverStale(h) {
+			break
+		}
 		runtime.Gosched()
 	}
+	atomic.StoreUint64(&l.started, selfStartTime)
+}
+
+// recoverStale 持有锁的进程已经退出, 直接把锁抢过来, 成功返回true.
+// 同时比较pid和启动时间, pid被复用或者持有者在其他pid命名空间中时不会误抢
+func (l *processLocker) recoverStale(h holderChecker) bool {
+	owner := atomic.LoadInt32(&l.write)
+	if owner == 0 || owner == selfPid {
+		return false
+	}
+	// started可能属于之后的持有者, 这时下面CAS owner会失败
+	started := atomic.LoadUint64(&l.started)
+	if h != nil && h.holderAlive(owner, started) || h == nil && processAlive(owner, started) {
+		return false
+	}
+	return atomic.CompareAndSwapInt32(&l.write, owner, selfPid)
 }
 
 func (l *processLocker) Unlock() {
-	if !atomic.CompareAndSwapInt32(&l.write, 1, 0) {
+	// 先清掉启动时间, 下一个持有者写入之前其他进程只会按pid判断
+	atomic.StoreUint64(&l.started, 0)
+	if !atomic.CompareAndSwapInt32(&l.write, selfPid, 0) {
 		panic("unlock an unlocked-lock")
 	}
 }
@@ -34,6 +68,21 @@ func (l *processLocker) Unlock() {
 func (l *processLocker) Reset() {
 	l.write = 0
 	l.read = 0
+	l.started = 0
+}
+
+// segmentLocker 共享内存中的全局锁, 判断持有者是否存活时结合进程注册表
+type segmentLocker struct {
+	locker *processLocker
+	h      holderChecker
+}
+
+func (l *segmentLocker) Lock() {
+	l.locker.lock(l.h)
+}
+
+func (l *segmentLocker) Unlock() {
+	l.locker.Unlock()
 }
 
 type nopLocker struct{}
@@ -0,0 +1,121 @@
+package fastcache
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// memfdMemory memfd_create创建的匿名共享内存, 没有文件路径, 其他进程通过继承fd或者SCM_RIGHTS传递fd挂载,
+// 所有引用fd的进程退出后内核自动释放
+type memfdMemory struct {
+	mappedMemory
+	fd int
+}
+
+// newMemfdMemory fd大于0时挂载已经存在的memfd, 否则以name创建一个新的memfd
+func newMemfdMemory(name string, fd int, size uint64, readOnly bool) (Memory, error) {
+	m := &memfdMemory{fd: fd}
+	m.attach = func() ([]byte, error) {
+		if err := m.open(name, size, readOnly); err != nil {
+			return nil, err
+		}
+		prot := unix.PROT_READ | unix.PROT_WRITE
+		if readOnly {
+			prot = unix.PROT_READ
+		}
+		data, err := unix.Mmap(m.fd, 0, int(size), prot, unix.MAP_SHARED)
+		if err != nil {
+			_ = unix.Close(m.fd)
+			m.fd = -1
+		}
+		return data, err
+	}
+	m.detach = func(data []byte) error {
+		err := unix.Munmap(data)
+		if m.fd > 0 {
+			err = errors.Join(err, unix.Close(m.fd))
+			m.fd = -1
+		}
+		return err
+	}
+	return m, nil
+}
+
+func (m *memfdMemory) open(name string, size uint64, readOnly bool) error {
+	if m.fd <= 0 {
+		if readOnly {
+			return ErrSegmentNotInitialized
+		}
+		fd, err := unix.MemfdCreate(name, unix.MFD_CLOEXEC)
+		if err != nil {
+			return err
+		}
+		m.fd = fd
+		return unix.Ftruncate(fd, int64(size))
+	}
+	var st unix.Stat_t
+	if err := unix.Fstat(m.fd, &st); err != nil {
+		return err
+	}
+	if uint64(st.Size) >= size {
+		return nil
+	}
+	if readOnly {
+		return ErrSegmentNotInitialized
+	}
+	return unix.Ftruncate(m.fd, int64(size))
+}
+
+// MemoryFd returns the memfd of a MEMFD cache, pass it to a child process with exec.Cmd.ExtraFiles and
+// attach it there with Config.MemoryFd. The fd is owned by the cache and closed by Close.
+func MemoryFd(c Cache) (int, error) {
+	ca, ok := c.(*cache)
+	if !ok {
+		return -1, fmt.Errorf("cache %T has no memory fd", c)
+	}
+	m, ok := ca.allocator.mem.(*memfdMemory)
+	if !ok || m.fd <= 0 {
+		return -1, fmt.Errorf("MemoryType: %d has no memory fd", ca.memoryType)
+	}
+	return m.fd, nil
+}
+
+// SendMemoryFd sends the memfd of a MEMFD cache to another process over a unix socket with SCM_RIGHTS
+func SendMemoryFd(conn *net.UnixConn, c Cache) error {
+	fd, err := MemoryFd(c)
+	if err != nil {
+		return err
+	}
+	_, _, err = conn.WriteMsgUnix([]byte{0}, unix.UnixRights(fd), nil)
+	return err
+}
+
+// ReceiveMemoryFd receives a memfd sent by SendMemoryFd, attach it with Config.MemoryFd
+func ReceiveMemoryFd(conn *net.UnixConn) (int, error) {
+	oob := make([]byte, unix.CmsgSpace(4))
+	_, oobn, _, _, err := conn.ReadMsgUnix(make([]byte, 1), oob)
+	if err != nil {
+		return -1, err
+	}
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return -1, err
+	}
+	if len(msgs) != 1 {
+		return -1, errors.New("no memory fd received")
+	}
+	fds, err := unix.ParseUnixRights(&msgs[0])
+	if err != nil {
+		return -1, err
+	}
+	if len(fds) != 1 {
+		for _, fd := range fds {
+			_ = unix.Close(fd)
+		}
+		return -1, errors.New("expect exactly one memory fd")
+	}
+	return fds[0], nil
+}
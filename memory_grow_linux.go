@@ -0,0 +1,170 @@
+//go:build linux && (amd64 || arm64 || loong64 || mips64 || mips64le || ppc64 || ppc64le || riscv64 || s390x)
+
+package fastcache
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// growMemory 可以扩容的MMAP, 挂载时按最大大小预留一段连续的地址空间, 扩容时把文件新增的部分用MAP_FIXED映射到预留空间的后面,
+// 已经映射的部分地址不变, 扩容过程中其他goroutine可以继续访问
+type growMemory struct {
+	key      string
+	initial  uint64
+	max      uint64
+	readOnly bool
+
+	mu       sync.Mutex
+	file     *os.File
+	reserved []byte // 预留的地址空间, 长度为max
+	size     uint64 // 已经映射的大小
+}
+
+func newGrowMemory(key string, initial uint64, max uint64, readOnly bool) (Memory, error) {
+	return &growMemory{key: key, initial: initial, max: max, readOnly: readOnly}, nil
+}
+
+func (m *growMemory) Attach() (err error) {
+	if m.file != nil {
+		return nil
+	}
+	flag, prot := os.O_RDWR|os.O_CREATE, unix.PROT_READ|unix.PROT_WRITE
+	if m.readOnly {
+		flag, prot = os.O_RDONLY, unix.PROT_READ
+	}
+	f, err := os.OpenFile(m.key, flag, 0666)
+	if err != nil {
+		if m.readOnly && errors.Is(err, os.ErrNotExist) {
+			return ErrSegmentNotInitialized
+		}
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+		}
+	}()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := uint64(st.Size())
+	if size < m.initial {
+		if m.readOnly {
+			return ErrSegmentNotInitialized
+		}
+		// 只能变大, 已经扩容过的文件不能被截断
+		if err = f.Truncate(int64(m.initial)); err != nil {
+			return err
+		}
+		size = m.initial
+	}
+	if size > m.max {
+		return fmt.Errorf("mmap file size %d exceeds max size %d", size, m.max)
+	}
+
+	reserved, err := unix.Mmap(-1, 0, int(m.max), unix.PROT_NONE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS|unix.MAP_NORESERVE)
+	if err != nil {
+		return err
+	}
+	if err = mmapFixed(unsafe.Pointer(unsafe.SliceData(reserved)), size, prot, f, 0); err != nil {
+		_ = unix.Munmap(reserved)
+		return err
+	}
+	m.file, m.reserved = f, reserved
+	atomic.StoreUint64(&m.size, size)
+	return nil
+}
+
+func (m *growMemory) Detach() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.file == nil {
+		return nil
+	}
+	// 预留的地址空间包含了所有映射的部分, 一次全部释放
+	err := unix.Munmap(m.reserved)
+	m.reserved = nil
+	atomic.StoreUint64(&m.size, 0)
+	return errors.Join(err, m.file.Close())
+}
+
+// extend 把文件[当前映射大小, size)的部分映射进来, 文件需要已经足够大
+func (m *growMemory) extend(size uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cur := atomic.LoadUint64(&m.size)
+	if size <= cur {
+		return nil
+	}
+	if size > m.max {
+		return fmt.Errorf("mmap size %d exceeds max size %d", size, m.max)
+	}
+	prot := unix.PROT_READ | unix.PROT_WRITE
+	if m.readOnly {
+		prot = unix.PROT_READ
+	}
+	if err := mmapFixed(unsafe.Add(m.Ptr(), cur), size-cur, prot, m.file, cur); err != nil {
+		return err
+	}
+	atomic.StoreUint64(&m.size, size)
+	return nil
+}
+
+// grow 扩大文件并且映射, 调用方需要持有全局分配锁
+func (m *growMemory) grow(size uint64) error {
+	if m.readOnly {
+		return ErrReadOnly
+	}
+	if err := m.file.Truncate(int64(size)); err != nil {
+		return err
+	}
+	return m.extend(size)
+}
+
+func (m *growMemory) maxSize() uint64 {
+	return m.max
+}
+
+func (m *growMemory) Ptr() unsafe.Pointer {
+	return unsafe.Pointer(unsafe.SliceData(m.reserved))
+}
+
+func (m *growMemory) Size() uint64 {
+	return atomic.LoadUint64(&m.size)
+}
+
+func (m *growMemory) PtrOffset(offset uint64) unsafe.Pointer {
+	if size := m.Size(); offset >= size {
+		panic(fmt.Errorf("offset overflow: %d > %d", offset, size))
+	}
+	return unsafe.Add(m.Ptr(), offset)
+}
+
+func (m *growMemory) Travel(skipOffset uint64, fn func(ptr unsafe.Pointer, size uint64) uint64) {
+	size := m.Size()
+	for skipOffset < size {
+		if advanceBytes := fn(m.PtrOffset(skipOffset), size-skipOffset); advanceBytes > 0 {
+			skipOffset += advanceBytes
+			continue
+		}
+		break
+	}
+}
+
+// mmapFixed 把文件offset开始的length字节映射到addr, 覆盖预留的地址空间
+func mmapFixed(addr unsafe.Pointer, length uint64, prot int, f *os.File, offset uint64) error {
+	_, _, errno := unix.Syscall6(unix.SYS_MMAP, uintptr(addr), uintptr(length), uintptr(prot),
+		uintptr(unix.MAP_SHARED|unix.MAP_FIXED), f.Fd(), uintptr(offset))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,7 @@
+//go:build !linux || !(amd64 || arm64 || loong64 || mips64 || mips64le || ppc64 || ppc64le || riscv64 || s390x)
+
+package fastcache
+
+func newGrowMemory(key string, initial uint64, max uint64, readOnly bool) (Memory, error) {
+	return nil, ErrNotSupported
+}
@@ -0,0 +1,175 @@
+package fastcache
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// mappedMemory 基于一段已经映射好的内存实现Memory, 用于memcore没有提供的映射方式
+type mappedMemory struct {
+	data   []byte
+	attach func() ([]byte, error)
+	detach func(data []byte) error
+}
+
+func (m *mappedMemory) Attach() (err error) {
+	if m.data == nil {
+		m.data, err = m.attach()
+	}
+	return
+}
+
+func (m *mappedMemory) Detach() error {
+	if m.data == nil {
+		return nil
+	}
+	data := m.data
+	m.data = nil
+	return m.detach(data)
+}
+
+func (m *mappedMemory) Ptr() unsafe.Pointer {
+	return unsafe.Pointer(unsafe.SliceData(m.data))
+}
+
+func (m *mappedMemory) Size() uint64 {
+	return uint64(len(m.data))
+}
+
+func (m *mappedMemory) PtrOffset(offset uint64) unsafe.Pointer {
+	if offset >= uint64(len(m.data)) {
+		panic(fmt.Errorf("offset overflow: %d > %d", offset, len(m.data)))
+	}
+	return unsafe.Pointer(&m.data[offset])
+}
+
+func (m *mappedMemory) Travel(skipOffset uint64, fn func(ptr unsafe.Pointer, size uint64) uint64) {
+	size := uint64(len(m.data))
+	for skipOffset < size {
+		if advanceBytes := fn(m.PtrOffset(skipOffset), size-skipOffset); advanceBytes > 0 {
+			skipOffset += advanceBytes
+			continue
+		}
+		break
+	}
+}
+
+// existingSHM 挂载已经存在的SHM, 保留shmid, 最后一个进程Destroy之后可以删除key
+type existingSHM struct {
+	mappedMemory
+	id int
+}
+
+func (m *existingSHM) Handle() uint64 {
+	return uint64(m.id)
+}
+
+// newExistingMemory 映射已经存在的共享内存, 不存在或者比size小时返回ErrSegmentNotInitialized, 不会创建.
+// readOnly时以PROT_READ/SHM_RDONLY的方式映射, 只读进程写入会直接触发SIGSEGV
+func newExistingMemory(memoryType MemoryType, key string, size uint64, readOnly bool) (Memory, error) {
+	shmFlag, flag, prot := unix.SHM_RDONLY, os.O_RDONLY, unix.PROT_READ
+	if !readOnly {
+		shmFlag, flag, prot = 0, os.O_RDWR, unix.PROT_READ|unix.PROT_WRITE
+	}
+	switch memoryType {
+	case SHM:
+		m := &existingSHM{}
+		m.attach = func() ([]byte, error) {
+			id, err := unix.SysvShmGet(int(crc32.ChecksumIEEE([]byte(key))), int(size), 0600)
+			if err != nil {
+				if errors.Is(err, unix.ENOENT) {
+					return nil, ErrSegmentNotInitialized
+				}
+				return nil, err
+			}
+			m.id = id
+			return unix.SysvShmAttach(id, 0, shmFlag)
+		}
+		m.detach = unix.SysvShmDetach
+		return m, nil
+	case MMAP:
+		return &mappedMemory{
+			attach: func() ([]byte, error) {
+				f, err := os.OpenFile(key, flag, 0)
+				if err != nil {
+					if errors.Is(err, os.ErrNotExist) {
+						return nil, ErrSegmentNotInitialized
+					}
+					return nil, err
+				}
+				defer f.Close()
+				st, err := f.Stat()
+				if err != nil {
+					return nil, err
+				}
+				if uint64(st.Size()) < size {
+					return nil, ErrSegmentNotInitialized
+				}
+				// 扩容过的文件比size大, 映射整个文件
+				return unix.Mmap(int(f.Fd()), 0, int(st.Size()), prot, unix.MAP_SHARED)
+			},
+			detach: unix.Munmap,
+		}, nil
+	default:
+		return nil, fmt.Errorf("MemoryType: %d not support attaching an existing segment", memoryType)
+	}
+}
+
+// removeSHM 删除SHM的key, 已经挂载的进程不受影响, 内核会在最后一个进程detach之后释放内存
+func removeSHM(mem Memory) error {
+	h, ok := mem.(interface{ Handle() uint64 })
+	if !ok {
+		return fmt.Errorf("memory %T has no shm handle", mem)
+	}
+	_, err := unix.SysvShmCtl(int(h.Handle()), unix.IPC_RMID, nil)
+	return err
+}
+
+// prefault 挂载之后马上让从from开始的所有页都映射好, 之后第一次写入新分配的区域不会再缺页.
+// 优先用MADV_POPULATE_WRITE/READ(linux 5.14+), 不支持时逐页访问
+func prefault(mem Memory, from uint64, readOnly bool) {
+	advice := unix.MADV_POPULATE_WRITE
+	if readOnly {
+		advice = unix.MADV_POPULATE_READ
+	}
+	from &^= pageSize - 1
+	if unix.Madvise(unsafe.Slice((*byte)(mem.PtrOffset(from)), mem.Size()-from), advice) == nil {
+		return
+	}
+	touchPages(mem, from, readOnly)
+}
+
+// mlock 锁住从from开始的内存, 不会被换出到swap, 受RLIMIT_MEMLOCK限制
+func mlock(mem Memory, from uint64) error {
+	return unix.Mlock(unsafe.Slice((*byte)(mem.PtrOffset(from)), mem.Size()-from))
+}
+
+func munlock(mem Memory) error {
+	return unix.Munlock(unsafe.Slice((*byte)(mem.Ptr()), mem.Size()))
+}
+
+// msync 把映射的内存同步写回文件
+func msync(mem Memory) error {
+	return unix.Msync(unsafe.Slice((*byte)(mem.Ptr()), mem.Size()), unix.MS_SYNC)
+}
+
+// lockFile 对path加排它的flock, 进程退出时内核自动释放, 不存在时创建
+func lockFile(path string) (unlock func(), err error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if err = unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		_ = unix.Flock(int(f.Fd()), unix.LOCK_UN)
+		f.Close()
+	}, nil
+}
@@ -0,0 +1,71 @@
+//go:build !linux
+
+package fastcache
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/leslie-fei/memcore/mmap"
+	"github.com/leslie-fei/memcore/shm"
+)
+
+// newExistingMemory 非linux平台没有只读映射, 退化为读写映射, 只读由cache的API保证
+func newExistingMemory(memoryType MemoryType, key string, size uint64, readOnly bool) (Memory, error) {
+	switch memoryType {
+	case SHM:
+		return shm.NewMemory(key, size, false), nil
+	case MMAP:
+		return mmap.NewMemory(key, size), nil
+	default:
+		return nil, fmt.Errorf("MemoryType: %d not support attaching an existing segment", memoryType)
+	}
+}
+
+func removeSHM(mem Memory) error {
+	return ErrNotSupported
+}
+
+func msync(mem Memory) error {
+	return ErrNotSupported
+}
+
+func newMemfdMemory(name string, fd int, size uint64, readOnly bool) (Memory, error) {
+	return nil, ErrNotSupported
+}
+
+func newHugePageMemory(key string, size uint64, readOnly bool) (Memory, error) {
+	return nil, ErrNotSupported
+}
+
+// MemoryFd returns the memfd of a MEMFD cache, MEMFD is linux only
+func MemoryFd(c Cache) (int, error) {
+	return -1, ErrNotSupported
+}
+
+// SendMemoryFd sends the memfd of a MEMFD cache over a unix socket, MEMFD is linux only
+func SendMemoryFd(conn *net.UnixConn, c Cache) error {
+	return ErrNotSupported
+}
+
+// ReceiveMemoryFd receives a memfd sent by SendMemoryFd, MEMFD is linux only
+func ReceiveMemoryFd(conn *net.UnixConn) (int, error) {
+	return -1, ErrNotSupported
+}
+
+func prefault(mem Memory, from uint64, readOnly bool) {
+	touchPages(mem, from, readOnly)
+}
+
+func mlock(mem Memory, from uint64) error {
+	return ErrNotSupported
+}
+
+func munlock(mem Memory) error {
+	return ErrNotSupported
+}
+
+// lockFile 其他平台不支持flock, 由调用方保证挂载不会并发
+func lockFile(path string) (unlock func(), err error) {
+	return func() {}, nil
+}
@@ -1,22 +1,59 @@
 package fastcache
 
-import "unsafe"
+import (
+	"sync/atomic"
+	"unsafe"
+)
 
 var sizeOfMetadata = unsafe.Sizeof(metadata{})
 
+const (
+	// metaFlagDestroyPending 调用过Destroy, 最后一个进程退出时删除共享内存
+	metaFlagDestroyPending uint32 = 1 << iota
+	// metaFlagDurable 持久化的MMAP, 分片加锁后需要标记checkpoint已经失效
+	metaFlagDurable
+)
+
 type metadata struct {
 	Magic          uint64
+	Layout         uint64 // 共享结构体布局指纹, 必须紧跟Magic, 保证任何版本都能在同一位置读到
 	Hash           uint64
 	TotalSize      uint64
 	Used           uint64
 	LockerOffset   uint64
 	ShardArrOffset uint64
+	Refs           int32  // 挂载的进程数量, 只读进程不计数
+	Flags          uint32 // metaFlagXXX
+	Procs          procTable
+	Leader         leaderLease
+	Checkpoint     checkpointHeader
+	Generation     uint64 // 每次扩容+1, 其他进程发现变化之后映射新增的部分
 }
 
 func (m *metadata) reset() {
 	m.Magic = 0
+	m.Layout = 0
 	m.Hash = 0
 	m.TotalSize = 0
 	m.Used = 0
 	m.ShardArrOffset = 0
+	m.Refs = 0
+	m.Flags = 0
+	m.Procs.reset()
+	m.Leader.reset()
+	m.Checkpoint.reset()
+	m.Generation = 0
+}
+
+func (m *metadata) hasFlag(flag uint32) bool {
+	return atomic.LoadUint32(&m.Flags)&flag != 0
+}
+
+func (m *metadata) setFlag(flag uint32) {
+	for {
+		old := atomic.LoadUint32(&m.Flags)
+		if old&flag != 0 || atomic.CompareAndSwapUint32(&m.Flags, old, old|flag) {
+			return
+		}
+	}
 }
@@ -0,0 +1,143 @@
+package fastcache
+
+import (
+	"errors"
+	"runtime"
+	"unsafe"
+)
+
+// migrateBatch 迁移时每次持有分片锁拷贝的元素数量
+const migrateBatch = 256
+
+func (c *cache) Migrate(dst Cache) error {
+	if d, ok := dst.(*cache); ok && d == c {
+		return errors.New("migrate to itself")
+	}
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	if !c.enter() {
+		return ErrCacheClosed
+	}
+	defer c.exit()
+
+	entries := make([]snapshotEntry, 0, migrateBatch)
+	for i := 0; i < int(c.shards.Len()); i++ {
+		shr := c.shards.shard(c.allocator, i)
+		if err := shr.lruBatches(c.allocator, migrateBatch, func(keys [][]byte) error {
+			entries = shr.copyEntries(c.allocator, keys, entries[:0])
+			for j := range entries {
+				if err := migrateEntry(dst, &entries[j]); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func migrateEntry(dst Cache, entry *snapshotEntry) error {
+	d, ok := dst.(*cache)
+	if !ok {
+		return dst.Set(entry.key, entry.value)
+	}
+	// 同样是cache时保留访问计数
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	if !d.enter() {
+		return ErrCacheClosed
+	}
+	defer d.exit()
+	hash := xxHashBytes(entry.key)
+	d.counters.add(hash, opSet)
+	return d.shard(hash, entry.key).restore(d.allocator, hash, entry)
+}
+
+// lruCursor 分批遍历LRU时上一批最后一个元素, 重新加锁之后从它继续
+type lruCursor struct {
+	key     []byte
+	hash    uint64
+	version uint64
+	count   uint8
+	older   uint64 // 更旧的相邻节点的偏移量
+}
+
+// lruBatches 按LRU从旧到新的顺序分批拷贝分片中所有的key, 每批最多batch个, 只在拷贝一批的时候持有锁,
+// 释放锁之后调用fn. 两批之间元素可能被访问或者删除, 重复的key会跳过
+func (s *shard) lruBatches(all *allocator, batch int, fn func(keys [][]byte) error) error {
+	seen := make(map[string]struct{})
+	keys := make([][]byte, 0, batch)
+	for i := 0; i < len(s.lruStore(all).lruLists); i++ {
+		var cur lruCursor
+		for done := false; !done; {
+			keys, done = s.lruBatch(all, uint8(i), &cur, seen, keys[:0], batch)
+			if len(keys) == 0 {
+				continue
+			}
+			if err := fn(keys); err != nil {
+				return err
+			}
+			// 让出CPU, 线上的请求不会被饿死
+			runtime.Gosched()
+		}
+	}
+	return nil
+}
+
+// lruBatch 持有锁从cur之后拷贝最多batch个没有见过的key, 返回true表示已经到了LRU头部.
+// 访问和写入都会修改count或者version, 两者都没变并且相邻的节点也没变才认为cur还在原来的位置,
+// 否则从尾部重新开始, 跳过已经拷贝过的key
+func (s *shard) lruBatch(all *allocator, index uint8, cur *lruCursor, seen map[string]struct{}, keys [][]byte, batch int) ([][]byte, bool) {
+	s.lock(all)
+	defer s.unlock(all)
+	base := all.base()
+	l := s.lruStore(all).get(index)
+	ln := l.Back(base)
+	if cur.key != nil {
+		if _, node := s.hashmap(all).find(all, cur.hash, cur.key); node != nil && node.freeIndex == index {
+			el := nodeTo[hashmapBucketElement](node)
+			if el.version == cur.version && node.count == cur.count && el.lruNode().next == cur.older {
+				ln = el.lruNode().Prev(base)
+			}
+		}
+	}
+	for n := uint64(0); ln != nil && ln != &l.root && n < l.len; ln, n = ln.Prev(base), n+1 {
+		el := (*hashmapBucketElement)(unsafe.Add(unsafe.Pointer(ln), -int(sizeOfHashmapBucketElement)))
+		if _, ok := seen[string(el.key())]; ok {
+			continue
+		}
+		key := append([]byte(nil), el.key()...)
+		seen[string(key)] = struct{}{}
+		keys = append(keys, key)
+		if len(keys) == batch {
+			node := (*dataNode)(unsafe.Add(unsafe.Pointer(el), -int(sizeOfDataNode)))
+			*cur = lruCursor{key: key, hash: el.hash, version: el.version, count: node.count, older: ln.next}
+			return keys, ln.Prev(base) == &l.root
+		}
+	}
+	return keys, true
+}
+
+// copyEntries 拷贝一批key当前的值, 拷贝key之后已经被删除的跳过
+func (s *shard) copyEntries(all *allocator, keys [][]byte, entries []snapshotEntry) []snapshotEntry {
+	s.lock(all)
+	defer s.unlock(all)
+	for _, key := range keys {
+		_, node := s.lookup(all, xxHashBytes(key), key)
+		if node == nil {
+			continue
+		}
+		el := nodeTo[hashmapBucketElement](node)
+		entries = append(entries, snapshotEntry{
+			count:    node.count,
+			expireAt: el.expireAt,
+			key:      key,
+			value:    append([]byte(nil), el.value()...),
+		})
+	}
+	return entries
+}
@@ -0,0 +1,24 @@
+package fastcache
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+// pageSize 按最小的页大小访问, 大页时多访问几次也没有关系
+const pageSize = 4 * KB
+
+// touchPages 访问from之后的每一个页触发缺页, 写进程原子加0, 不会改变内容, 其他进程同时修改也是安全的
+func touchPages(mem Memory, from uint64, readOnly bool) {
+	ptr, size := mem.Ptr(), mem.Size()
+	var sum byte
+	for offset := from &^ (pageSize - 1); offset+4 <= size; offset += pageSize {
+		p := unsafe.Add(ptr, offset)
+		if readOnly {
+			sum += *(*byte)(p)
+			continue
+		}
+		atomic.AddUint32((*uint32)(p), 0)
+	}
+	_ = sum
+}
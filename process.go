@@ -0,0 +1,220 @@
+package fastcache
+
+import (
+	"os"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// maxProcesses 同一块共享内存最多同时挂载的进程数量
+const maxProcesses = 128
+
+var (
+	sizeOfProcTable = unsafe.Sizeof(procTable{})
+	// selfPid 当前进程的pid, 同时也是processLocker中记录的持有者
+	selfPid = int32(os.Getpid())
+	// selfStartTime 当前进程的启动时间, 用来防止pid被复用后误判为存活
+	selfStartTime = processStartTime(selfPid)
+	// selfPidNS 当前进程的pid命名空间
+	selfPidNS = processNamespace()
+)
+
+// ProcessInfo a process attached to the cache segment, Started is zero when the start time is unknown
+type ProcessInfo struct {
+	PID       int
+	Started   time.Time
+	Attached  time.Time
+	Heartbeat time.Time
+	Gets      uint64
+	Sets      uint64
+	Deletes   uint64
+}
+
+// procSlot 一个挂载的进程, pid为0表示空闲
+type procSlot struct {
+	owner     uint64 // gen<<32 | pid, gen每次注册+1, 注销和清理都CAS整个owner, 不会误删别人重新注册的slot
+	started   uint64 // 进程启动时间, 平台相关, 0表示未知
+	pidNS     uint64 // 进程所在的pid命名空间, 0表示未知. 不同命名空间的pid没有办法用kill判断
+	attached  int64  // 挂载时间 unix nano
+	heartbeat int64  // 最后一次心跳 unix nano
+	gets      uint64
+	sets      uint64
+	deletes   uint64
+}
+
+// procTable 保存在metadata中的进程注册表
+type procTable struct {
+	slots [maxProcesses]procSlot
+}
+
+func slotPid(owner uint64) int32 {
+	return int32(uint32(owner))
+}
+
+// register 为当前进程占用一个空闲的slot, 同一个进程多次挂载会占用多个slot. 返回slot的位置和owner,
+// 之后的心跳和注销都要带上owner
+func (t *procTable) register(pid int32) (int, uint64, error) {
+	now := time.Now().UnixNano()
+	for i := range t.slots {
+		slot := &t.slots[i]
+		cur := atomic.LoadUint64(&slot.owner)
+		if slotPid(cur) != 0 {
+			continue
+		}
+		owner := (cur>>32+1)<<32 | uint64(uint32(pid))
+		if atomic.CompareAndSwapUint64(&slot.owner, cur, owner) {
+			atomic.StoreUint64(&slot.started, selfStartTime)
+			atomic.StoreUint64(&slot.pidNS, selfPidNS)
+			atomic.StoreInt64(&slot.attached, now)
+			atomic.StoreInt64(&slot.heartbeat, now)
+			atomic.StoreUint64(&slot.gets, 0)
+			atomic.StoreUint64(&slot.sets, 0)
+			atomic.StoreUint64(&slot.deletes, 0)
+			return i, owner, nil
+		}
+	}
+	return -1, 0, ErrTooManyProcesses
+}
+
+// unregister 释放slot, 返回false表示slot已经被其他进程清理了, 这时Refs也已经由清理的进程减过
+func (t *procTable) unregister(index int, owner uint64) bool {
+	slot := &t.slots[index]
+	return atomic.CompareAndSwapUint64(&slot.owner, owner, owner>>32<<32)
+}
+
+// heartbeat 更新心跳和操作计数, slot已经不属于owner时返回false
+func (t *procTable) heartbeat(index int, owner uint64, gets, sets, deletes uint64) bool {
+	slot := &t.slots[index]
+	if atomic.LoadUint64(&slot.owner) != owner {
+		return false
+	}
+	atomic.StoreInt64(&slot.heartbeat, time.Now().UnixNano())
+	atomic.StoreUint64(&slot.gets, gets)
+	atomic.StoreUint64(&slot.sets, sets)
+	atomic.StoreUint64(&slot.deletes, deletes)
+	// 写入期间被清理并且重新注册的话, 新的owner在注册时会重新初始化这些字段
+	return atomic.LoadUint64(&slot.owner) == owner
+}
+
+// dead 判断slot中的进程是否已经退出. 和当前进程在同一个pid命名空间时以kill和启动时间为准,
+// 心跳晚了也不算退出; 其他命名空间或者没有办法判断的平台只能依赖心跳超时
+func (s *procSlot) dead(pid int32, now int64, timeout time.Duration) bool {
+	ns := atomic.LoadUint64(&s.pidNS)
+	if processCheckable && ns != 0 && ns == selfPidNS {
+		return !processAlive(pid, atomic.LoadUint64(&s.started))
+	}
+	return now-atomic.LoadInt64(&s.heartbeat) > int64(timeout)
+}
+
+// holderAlive 判断记录在锁或者租约中的进程是否存活. 持有者在注册表中时按注册表判断, 不会因为pid命名空间不同误判;
+// 不在注册表中的只能检查本命名空间中的进程. started不为0时还要求启动时间一致, 防止pid被复用
+func (t *procTable) holderAlive(pid int32, started uint64, timeout time.Duration) bool {
+	now := time.Now().UnixNano()
+	for i := range t.slots {
+		slot := &t.slots[i]
+		if slotPid(atomic.LoadUint64(&slot.owner)) != pid {
+			continue
+		}
+		if started != 0 && atomic.LoadUint64(&slot.started) != started {
+			continue
+		}
+		return !slot.dead(pid, now, timeout)
+	}
+	return processAlive(pid, started)
+}
+
+// prune 清理已经退出的进程, 返回清理的数量
+func (t *procTable) prune(self int, timeout time.Duration) int {
+	now := time.Now().UnixNano()
+	pruned := 0
+	for i := range t.slots {
+		if i == self {
+			continue
+		}
+		slot := &t.slots[i]
+		owner := atomic.LoadUint64(&slot.owner)
+		pid := slotPid(owner)
+		if pid == 0 {
+			continue
+		}
+		if !slot.dead(pid, now, timeout) {
+			continue
+		}
+		if atomic.CompareAndSwapUint64(&slot.owner, owner, owner>>32<<32) {
+			pruned++
+		}
+	}
+	return pruned
+}
+
+// live 当前注册的进程数量
+func (t *procTable) live() int {
+	n := 0
+	for i := range t.slots {
+		if slotPid(atomic.LoadUint64(&t.slots[i].owner)) != 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func (t *procTable) list() []ProcessInfo {
+	var infos []ProcessInfo
+	for i := range t.slots {
+		slot := &t.slots[i]
+		pid := slotPid(atomic.LoadUint64(&slot.owner))
+		if pid == 0 {
+			continue
+		}
+		infos = append(infos, ProcessInfo{
+			PID:       int(pid),
+			Started:   processStartedAt(atomic.LoadUint64(&slot.started)),
+			Attached:  time.Unix(0, atomic.LoadInt64(&slot.attached)),
+			Heartbeat: time.Unix(0, atomic.LoadInt64(&slot.heartbeat)),
+			Gets:      atomic.LoadUint64(&slot.gets),
+			Sets:      atomic.LoadUint64(&slot.sets),
+			Deletes:   atomic.LoadUint64(&slot.deletes),
+		})
+	}
+	return infos
+}
+
+func (t *procTable) reset() {
+	*t = procTable{}
+}
+
+func currentPid() int32 {
+	return selfPid
+}
+
+const (
+	opGet = iota
+	opSet
+	opDelete
+)
+
+// opCounter 按cache line对齐, 避免多个goroutine同时计数时的伪共享
+type opCounter struct {
+	ops [3]uint64
+	_   [40]byte
+}
+
+// opCounters 进程内的操作计数, 按hash分散到多个counter, 心跳时汇总写入进程注册表
+type opCounters struct {
+	counters [16]opCounter
+}
+
+func (o *opCounters) add(hash uint64, op int) {
+	atomic.AddUint64(&o.counters[hash&15].ops[op], 1)
+}
+
+func (o *opCounters) sum() (gets, sets, deletes uint64) {
+	for i := range o.counters {
+		c := &o.counters[i]
+		gets += atomic.LoadUint64(&c.ops[opGet])
+		sets += atomic.LoadUint64(&c.ops[opSet])
+		deletes += atomic.LoadUint64(&c.ops[opDelete])
+	}
+	return
+}
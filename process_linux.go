@@ -0,0 +1,98 @@
+package fastcache
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// processCheckable linux上可以通过kill和/proc判断进程是否存活
+const processCheckable = true
+
+// processAlive 进程是否存活, started不为0时还会比较进程启动时间, 防止pid被复用
+func processAlive(pid int32, started uint64) bool {
+	if err := unix.Kill(int(pid), 0); err != nil && !errors.Is(err, unix.EPERM) {
+		return false
+	}
+	if started == 0 {
+		return true
+	}
+	st := processStartTime(pid)
+	return st == 0 || st == started
+}
+
+// processNamespace 读取/proc/self/ns/pid的inode作为pid命名空间的标识, 读取失败返回0
+func processNamespace() uint64 {
+	link, err := os.Readlink("/proc/self/ns/pid")
+	if err != nil {
+		return 0
+	}
+	// 格式为pid:[4026531836]
+	start, end := strings.IndexByte(link, '['), strings.IndexByte(link, ']')
+	if start < 0 || end <= start {
+		return 0
+	}
+	v, err := strconv.ParseUint(link[start+1:end], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+// processStartTime 读取/proc/<pid>/stat中第22个字段starttime, 读取失败返回0
+func processStartTime(pid int32) uint64 {
+	b, err := os.ReadFile("/proc/" + strconv.Itoa(int(pid)) + "/stat")
+	if err != nil {
+		return 0
+	}
+	// comm字段可能包含空格, 从最后一个')'之后开始解析, 之后的第一个字段是第3个字段
+	idx := bytes.LastIndexByte(b, ')')
+	if idx < 0 {
+		return 0
+	}
+	fields := bytes.Fields(b[idx+1:])
+	if len(fields) < 20 {
+		return 0
+	}
+	v, err := strconv.ParseUint(string(fields[19]), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+// userHZ /proc中时间的单位clock tick, 内核对用户空间固定为每秒100
+const userHZ = 100
+
+// bootTime /proc/stat中的开机时间btime, 单位秒, 读取失败返回0
+var bootTime = sync.OnceValue(func() int64 {
+	b, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return 0
+	}
+	for _, line := range bytes.Split(b, []byte("\n")) {
+		if v, ok := bytes.CutPrefix(line, []byte("btime ")); ok {
+			btime, err := strconv.ParseInt(string(bytes.TrimSpace(v)), 10, 64)
+			if err != nil {
+				return 0
+			}
+			return btime
+		}
+	}
+	return 0
+})
+
+// processStartedAt 把processStartTime读到的开机之后的clock tick换算成时间, 未知时返回零值
+func processStartedAt(started uint64) time.Time {
+	boot := bootTime()
+	if started == 0 || boot == 0 {
+		return time.Time{}
+	}
+	return time.Unix(boot, 0).Add(time.Duration(started) * time.Second / userHZ)
+}
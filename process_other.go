@@ -0,0 +1,25 @@
+//go:build !linux
+
+package fastcache
+
+import "time"
+
+// processCheckable 其他平台没有可靠的方式判断进程是否存活, 只依赖心跳超时
+const processCheckable = false
+
+// processAlive 没有办法判断时当作存活, 不在注册表中的锁持有者不会被抢
+func processAlive(pid int32, started uint64) bool {
+	return true
+}
+
+func processStartTime(pid int32) uint64 {
+	return 0
+}
+
+func processStartedAt(started uint64) time.Time {
+	return time.Time{}
+}
+
+func processNamespace() uint64 {
+	return 0
+}
@@ -0,0 +1,88 @@
+package fastcache
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+var sizeOfUndoRecord = unsafe.Sizeof(undoRecord{})
+
+const (
+	undoNone uint32 = iota
+	// undoSet 正在写入hash对应的元素
+	undoSet
+	// undoDelete 正在删除hash对应的元素
+	undoDelete
+	// undoMove 正在移动LRU链表
+	undoMove
+)
+
+// undoRecord 分片正在进行的修改, op不为0说明分片处于修改中, 持有锁的进程退出后由下一个拿到锁的进程恢复
+type undoRecord struct {
+	op   uint32
+	_    uint32
+	hash uint64
+}
+
+// markDirty 持有锁的情况下, 修改hashmap, LRU链表或者free链表之前调用
+func (s *shard) markDirty(op uint32, hash uint64) {
+	s.undo.hash = hash
+	atomic.StoreUint32(&s.undo.op, op)
+}
+
+// clearDirty 修改完成, 和markDirty成对出现
+func (s *shard) clearDirty() {
+	atomic.StoreUint32(&s.undo.op, undoNone)
+}
+
+func (s *shard) lock(all *allocator) {
+	s.locker(all).lock(all)
+	all.remap()
+	if meta := all.metadata; meta.hasFlag(metaFlagDurable) {
+		meta.Checkpoint.markDirty()
+	}
+	if atomic.LoadUint32(&s.undo.op) != undoNone || atomic.LoadUint64(&s.seq)&1 == 1 {
+		// 上一个持有锁的进程在修改过程中退出了
+		s.recover(all)
+	}
+}
+
+func (s *shard) unlock(all *allocator) {
+	s.locker(all).Unlock()
+}
+
+// recover 恢复被中断的修改: 分片结构完整时只回滚正在写入的元素, 否则重置整个分片.
+// 调用方需要持有分片锁
+func (s *shard) recover(all *allocator) {
+	if atomic.LoadUint64(&s.seq)&1 == 1 {
+		atomic.AddUint64(&s.seq, 1)
+	}
+	s.beginWrite()
+	defer s.endWrite()
+
+	if len(s.verify(all)) > 0 {
+		s.reset(all)
+	} else if s.undo.op == undoSet {
+		// value可能只写了一半, 直接丢弃
+		s.dropHash(all, s.undo.hash)
+	}
+	s.clearDirty()
+}
+
+// dropHash 删除所有hash相同的元素
+func (s *shard) dropHash(all *allocator, hash uint64) {
+	hm := s.hashmap(all)
+	bucket := hm.byHash(all, hash)
+	var prev *dataNode
+	node := toDataNode(all, bucket.linkedFirstOffset)
+	for i := uint32(0); node != nil && i < bucket.len; {
+		next := toDataNode(all, node.next)
+		if nodeTo[hashmapBucketElement](node).hash == hash {
+			_ = s.del(all, hash, prev, node)
+		} else {
+			prev = node
+			i++
+		}
+		node = next
+	}
+}
@@ -0,0 +1,90 @@
+package fastcache
+
+import "unsafe"
+
+func (c *cache) Append(key []byte, data []byte) error {
+	return c.setRange(key, -1, data)
+}
+
+func (c *cache) SetRange(key []byte, offset int, data []byte) error {
+	if offset < 0 {
+		return ErrNegativeOffset
+	}
+	return c.setRange(key, offset, data)
+}
+
+func (c *cache) setRange(key []byte, offset int, data []byte) error {
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	if !c.enter() {
+		return ErrCacheClosed
+	}
+	defer c.exit()
+	hash := xxHashBytes(key)
+	c.counters.add(hash, opSet)
+	shr := c.shard(hash, key)
+	return shr.SetRange(c.allocator, hash, key, offset, data)
+}
+
+// SetRange 把data写到value的offset处, offset为-1时追加到末尾. 新的大小还在节点原来的大小分类内时原地修改,
+// 否则拷贝出完整的新值, 由set通过newElement换一个节点. 过期时间保持不变
+func (s *shard) SetRange(all *allocator, hash uint64, key []byte, offset int, data []byte) error {
+	s.lock(all)
+	defer s.unlock(all)
+
+	_, node := s.lookup(all, hash, key)
+	s.beginWrite()
+	defer s.endWrite()
+	s.markDirty(undoSet, hash)
+	defer s.clearDirty()
+
+	if node == nil {
+		if _, err := hashmapElementIndex(uint64(len(key)), uint64(max(offset, 0))+uint64(len(data))); err != nil {
+			return err
+		}
+		// 不存在时当作空值, offset之前补0
+		value := make([]byte, max(offset, 0)+len(data))
+		copy(value[max(offset, 0):], data)
+		if _, err := s.set(all, hash, key, value); err != nil {
+			return err
+		}
+		return all.journal(walSet, key, value)
+	}
+
+	el := nodeTo[hashmapBucketElement](node)
+	oldLen := int(el.valLen)
+	if offset < 0 {
+		offset = oldLen
+	}
+	// offset很大时在分配之前就拒绝, 避免构造超过最大分类的值
+	index, err := hashmapElementIndex(uint64(el.keyLen), max(uint64(oldLen), uint64(offset)+uint64(len(data))))
+	if err != nil {
+		return err
+	}
+	newLen := max(oldLen, offset+len(data))
+	expireAt := el.expireAt
+	if index > node.freeIndex {
+		value := make([]byte, newLen)
+		copy(value, el.valueView())
+		copy(value[offset:], data)
+		node, err := s.set(all, hash, key, value)
+		if err != nil {
+			return err
+		}
+		nodeTo[hashmapBucketElement](node).expireAt = expireAt
+		return all.journalSet(key, value, expireAt)
+	}
+
+	// 节点的空间足够放下newLen, 直接在共享内存中修改
+	buf := unsafe.Slice((*byte)(el.valPtr()), newLen)
+	if offset > oldLen {
+		// 中间空出来的部分可能是之前元素留下的数据
+		clear(buf[oldLen:offset])
+	}
+	copy(buf[offset:], data)
+	el.valLen = uint32(newLen)
+	s.stamp(el)
+	s.lruStore(all).moveToFront(all, node.freeIndex, el.lruNode())
+	return all.journalSet(key, el.valueView(), expireAt)
+}
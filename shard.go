@@ -4,6 +4,8 @@ import (
 	"errors"
 	"io"
 	"math"
+	"runtime"
+	"sync/atomic"
 	"unsafe"
 )
 
@@ -50,6 +52,9 @@ type shard struct {
 	freeStoreOffset uint64
 	lockerOffset    uint64
 	maxLen          uint64 // 当前shard, 最大容纳数量, 超过触发LRU
+	seq             uint64 // 修改hashmap或者元素内容时+1, 奇数表示正在修改, 只读进程用来判断读取是否一致
+	undo            undoRecord
+	version         uint64 // 最后分配的元素版本号, 只增不减, 重置分片也不会清零
 }
 
 func (s *shard) init(all *allocator, maxLen uint64) error {
@@ -99,17 +104,15 @@ func (s *shard) freeStore(all *allocator) *freeStore {
 	return (*freeStore)(unsafe.Pointer(all.base() + uintptr(s.freeStoreOffset)))
 }
 
-func (s *shard) locker(all *allocator) Locker {
+func (s *shard) locker(all *allocator) *processLocker {
 	return (*processLocker)(unsafe.Pointer(all.base() + uintptr(s.lockerOffset)))
 }
 
 func (s *shard) Has(all *allocator, hash uint64, key []byte) (uint8, bool) {
-	locker := s.locker(all)
-	locker.Lock()
-	defer locker.Unlock()
+	s.lock(all)
+	defer s.unlock(all)
 
-	hm := s.hashmap(all)
-	_, node := hm.find(all, hash, key)
+	_, node := s.lookup(all, hash, key)
 	if node == nil {
 		return 0, false
 	}
@@ -117,12 +120,10 @@ func (s *shard) Has(all *allocator, hash uint64, key []byte) (uint8, bool) {
 }
 
 func (s *shard) Get(all *allocator, hash uint64, key []byte) ([]byte, uint8, error) {
-	locker := s.locker(all)
-	locker.Lock()
-	defer locker.Unlock()
+	s.lock(all)
+	defer s.unlock(all)
 
-	hm := s.hashmap(all)
-	_, node := hm.find(all, hash, key)
+	_, node := s.lookup(all, hash, key)
 	if node == nil {
 		return nil, 0, ErrNotFound
 	}
@@ -132,18 +133,18 @@ func (s *shard) Get(all *allocator, hash uint64, key []byte) ([]byte, uint8, err
 	value := el.value()
 
 	ls := s.lruStore(all)
+	s.markDirty(undoMove, hash)
 	ls.moveToFront(all, node.freeIndex, el.lruNode())
+	s.clearDirty()
 
 	return value, node.count, nil
 }
 
 func (s *shard) GetWithBuffer(all *allocator, hash uint64, key []byte, buffer io.Writer) (uint8, error) {
-	locker := s.locker(all)
-	locker.Lock()
-	defer locker.Unlock()
+	s.lock(all)
+	defer s.unlock(all)
 
-	hm := s.hashmap(all)
-	_, node := hm.find(all, hash, key)
+	_, node := s.lookup(all, hash, key)
 	if node == nil {
 		return 0, ErrNotFound
 	}
@@ -155,17 +156,78 @@ func (s *shard) GetWithBuffer(all *allocator, hash uint64, key []byte, buffer io
 	}
 
 	ls := s.lruStore(all)
+	s.markDirty(undoMove, hash)
 	ls.moveToFront(all, node.freeIndex, el.lruNode())
+	s.clearDirty()
 	return node.count, nil
 }
 
+// View 持有分片锁调用fn, value直接指向共享内存, 先移动LRU再调用fn, fn里panic也不会留下修改了一半的LRU
+func (s *shard) View(all *allocator, hash uint64, key []byte, fn func(value []byte) error) error {
+	s.lock(all)
+	defer s.unlock(all)
+
+	_, node := s.lookup(all, hash, key)
+	if node == nil {
+		return ErrNotFound
+	}
+	node.count++
+
+	el := nodeTo[hashmapBucketElement](node)
+	ls := s.lruStore(all)
+	s.markDirty(undoMove, hash)
+	ls.moveToFront(all, node.freeIndex, el.lruNode())
+	s.clearDirty()
+
+	return fn(el.valueView())
+}
+
+func (s *shard) GetAppend(all *allocator, hash uint64, key []byte, dst []byte) ([]byte, error) {
+	s.lock(all)
+	defer s.unlock(all)
+
+	_, node := s.lookup(all, hash, key)
+	if node == nil {
+		return dst, ErrNotFound
+	}
+	node.count++
+
+	el := nodeTo[hashmapBucketElement](node)
+	dst = el.appendValue(dst)
+
+	ls := s.lruStore(all)
+	s.markDirty(undoMove, hash)
+	ls.moveToFront(all, node.freeIndex, el.lruNode())
+	s.clearDirty()
+	return dst, nil
+}
+
+func (s *shard) GetWithVersion(all *allocator, hash uint64, key []byte) ([]byte, uint64, error) {
+	s.lock(all)
+	defer s.unlock(all)
+
+	_, node := s.lookup(all, hash, key)
+	if node == nil {
+		return nil, 0, ErrNotFound
+	}
+	node.count++
+
+	el := nodeTo[hashmapBucketElement](node)
+	value := el.value()
+
+	ls := s.lruStore(all)
+	s.markDirty(undoMove, hash)
+	ls.moveToFront(all, node.freeIndex, el.lruNode())
+	s.clearDirty()
+
+	return value, el.version, nil
+}
+
 func (s *shard) Peek(all *allocator, hash uint64, key []byte) ([]byte, error) {
-	locker := s.locker(all)
-	locker.Lock()
-	defer locker.Unlock()
+	s.lock(all)
+	defer s.unlock(all)
 
-	hm := s.hashmap(all)
-	_, node := hm.find(all, hash, key)
+	_, node := s.lookup(all, hash, key)
 	if node == nil {
 		return nil, ErrNotFound
 	}
@@ -178,12 +240,10 @@ func (s *shard) Peek(all *allocator, hash uint64, key []byte) ([]byte, error) {
 }
 
 func (s *shard) PeekWithBuffer(all *allocator, hash uint64, key []byte, buffer io.Writer) error {
-	locker := s.locker(all)
-	locker.Lock()
-	defer locker.Unlock()
+	s.lock(all)
+	defer s.unlock(all)
 
-	hm := s.hashmap(all)
-	_, node := hm.find(all, hash, key)
+	_, node := s.lookup(all, hash, key)
 	if node == nil {
 		return ErrNotFound
 	}
@@ -193,11 +253,36 @@ func (s *shard) PeekWithBuffer(all *allocator, hash uint64, key []byte, buffer i
 	return el.valueWithBuffer(buffer)
 }
 
+func (s *shard) PeekAppend(all *allocator, hash uint64, key []byte, dst []byte) ([]byte, error) {
+	s.lock(all)
+	defer s.unlock(all)
+
+	_, node := s.lookup(all, hash, key)
+	if node == nil {
+		return dst, ErrNotFound
+	}
+	node.count++
+
+	el := nodeTo[hashmapBucketElement](node)
+	return el.appendValue(dst), nil
+}
+
 func (s *shard) Set(all *allocator, hash uint64, key []byte, value []byte) error {
-	locker := s.locker(all)
-	locker.Lock()
-	defer locker.Unlock()
+	s.lock(all)
+	defer s.unlock(all)
+	s.beginWrite()
+	defer s.endWrite()
+	s.markDirty(undoSet, hash)
+	defer s.clearDirty()
+
+	if _, err := s.set(all, hash, key, value); err != nil {
+		return err
+	}
+	return all.journal(walSet, key, value)
+}
 
+// set 写入或者覆盖key并且移动到LRU头部, 返回key所在的节点, 调用方需要持有分片锁并且标记了修改
+func (s *shard) set(all *allocator, hash uint64, key []byte, value []byte) (*dataNode, error) {
 	var err error
 	ls := s.lruStore(all)
 	hm := s.hashmap(all)
@@ -205,22 +290,24 @@ func (s *shard) Set(all *allocator, hash uint64, key []byte, value []byte) error
 	if node == nil {
 		node, err = s.newElement(all, hash, key, value)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		hm.add(all, hash, node)
 		el := nodeTo[hashmapBucketElement](node)
 		ls.pushToFront(all, node.freeIndex, el.lruNode())
 	} else {
-		elSize := hashmapElementSize(key, value)
-		index := sizeToIndex(elSize)
+		index, err := hashmapElementIndex(uint64(len(key)), uint64(len(value)))
+		if err != nil {
+			return nil, err
+		}
 		if index > node.freeIndex {
 			// Delete old node and new one to replace
 			old := node
 			if node, err = s.newElement(all, hash, key, value); err != nil {
-				return err
+				return nil, err
 			}
 			if err = s.del(all, hash, prev, old); err != nil {
-				return err
+				return nil, err
 			}
 			hm.add(all, hash, node)
 			el := nodeTo[hashmapBucketElement](node)
@@ -231,17 +318,151 @@ func (s *shard) Set(all *allocator, hash uint64, key []byte, value []byte) error
 			ls.moveToFront(all, node.freeIndex, el.lruNode())
 		}
 	}
+	el := nodeTo[hashmapBucketElement](node)
+	// 覆盖写入会清除过期时间
+	el.expireAt = 0
+	s.stamp(el)
+	return node, nil
+}
 
-	return nil
+// SetWithExpire 和Set一样, 写入之后设置过期时间, expireAt为unix nano
+func (s *shard) SetWithExpire(all *allocator, hash uint64, key []byte, value []byte, expireAt int64) error {
+	s.lock(all)
+	defer s.unlock(all)
+	s.beginWrite()
+	defer s.endWrite()
+	s.markDirty(undoSet, hash)
+	defer s.clearDirty()
+
+	node, err := s.set(all, hash, key, value)
+	if err != nil {
+		return err
+	}
+	nodeTo[hashmapBucketElement](node).expireAt = expireAt
+	return all.journalSet(key, value, expireAt)
+}
+
+// stamp 给刚写入的元素分配新的版本号
+func (s *shard) stamp(el *hashmapBucketElement) {
+	s.version++
+	el.version = s.version
+}
+
+// lookup 和hashmap.find一样, 但是过期的元素当作不存在, 并且顺便删除, 调用方需要持有分片锁.
+// 过期的删除不写WAL, 重放时过期时间也会一起恢复
+func (s *shard) lookup(all *allocator, hash uint64, key []byte) (prev *dataNode, node *dataNode) {
+	prev, node = s.hashmap(all).find(all, hash, key)
+	if node == nil || !nodeTo[hashmapBucketElement](node).isExpired() {
+		return
+	}
+	s.beginWrite()
+	defer s.endWrite()
+	s.markDirty(undoDelete, hash)
+	defer s.clearDirty()
+	_ = s.del(all, hash, prev, node)
+	return nil, nil
+}
+
+// SetIf 在分片锁内先用check检查key当前的元素, el为nil表示key不存在, check返回nil才写入, 返回写入之后的版本号
+func (s *shard) SetIf(all *allocator, hash uint64, key []byte, value []byte, check func(el *hashmapBucketElement) error) (uint64, error) {
+	s.lock(all)
+	defer s.unlock(all)
+
+	var el *hashmapBucketElement
+	if _, node := s.lookup(all, hash, key); node != nil {
+		el = nodeTo[hashmapBucketElement](node)
+	}
+	if err := check(el); err != nil {
+		return 0, err
+	}
+
+	s.beginWrite()
+	defer s.endWrite()
+	s.markDirty(undoSet, hash)
+	defer s.clearDirty()
+
+	node, err := s.set(all, hash, key, value)
+	if err != nil {
+		return 0, err
+	}
+	return nodeTo[hashmapBucketElement](node).version, all.journal(walSet, key, value)
 }
 
 func (s *shard) Delete(all *allocator, hash uint64, key []byte) error {
-	locker := s.locker(all)
-	locker.Lock()
-	defer locker.Unlock()
+	s.lock(all)
+	defer s.unlock(all)
+	prev, node := s.lookup(all, hash, key)
+	s.beginWrite()
+	defer s.endWrite()
+	s.markDirty(undoDelete, hash)
+	defer s.clearDirty()
+	if err := s.del(all, hash, prev, node); err != nil {
+		return err
+	}
+	return all.journal(walDelete, key, nil)
+}
+
+// beginWrite 持有锁的情况下修改hashmap链表或者元素内容前调用, 和endWrite成对出现
+func (s *shard) beginWrite() {
+	atomic.AddUint64(&s.seq, 1)
+}
+
+func (s *shard) endWrite() {
+	atomic.AddUint64(&s.seq, 1)
+}
+
+// optimisticRead 只读进程没有办法加锁, 以seqlock的方式乐观读取: 读取前后seq一致并且为偶数才认为读到的数据完整, 否则重试.
+// fn可能被调用多次, 也可能读到不完整的数据, 只有最后一次调用的结果有效, node为nil表示key不存在
+func (s *shard) optimisticRead(all *allocator, hash uint64, key []byte, fn func(node *dataNode, el *hashmapBucketElement)) {
+	s.seqRead(all, func() {
+		node := s.safeFind(all, hash, key)
+		if node == nil || nodeTo[hashmapBucketElement](node).isExpired() {
+			fn(nil, nil)
+		} else {
+			fn(node, nodeTo[hashmapBucketElement](node))
+		}
+	})
+}
+
+// seqRead 不加锁重复执行fn, 直到执行前后seq一致并且为偶数, 即执行期间没有其他进程修改分片
+func (s *shard) seqRead(all *allocator, fn func()) {
+	all.remap()
+	for {
+		seq := atomic.LoadUint64(&s.seq)
+		if seq&1 == 1 {
+			runtime.Gosched()
+			continue
+		}
+		fn()
+		if atomic.LoadUint64(&s.seq) == seq {
+			return
+		}
+	}
+}
+
+// safeFind 和hashmap.find一样, 但是会检查每一个偏移量都在映射的内存范围内, 读到写了一半的数据也不会越界访问
+func (s *shard) safeFind(all *allocator, hash uint64, key []byte) *dataNode {
 	hm := s.hashmap(all)
-	prev, node := hm.find(all, hash, key)
-	return s.del(all, hash, prev, node)
+	bucket := hm.byHash(all, hash)
+	offset := bucket.linkedFirstOffset
+	headSize := uint64(sizeOfDataNode + sizeOfHashmapBucketElement + sizeOfLRUNode)
+	for i := uint32(0); i < bucket.len; i++ {
+		if !all.inBounds(offset, headSize) {
+			return nil
+		}
+		node := toDataNode(all, offset)
+		el := nodeTo[hashmapBucketElement](node)
+		if el.hash == hash && el.keyLen == uint32(len(key)) {
+			if !all.inBounds(offset, headSize+uint64(el.keyLen)+uint64(el.valLen)) {
+				return nil
+			}
+			if el.equal(key) {
+				return node
+			}
+		}
+		offset = node.next
+	}
+	return nil
 }
 
 func (s *shard) del(all *allocator, hash uint64, prev *dataNode, node *dataNode) error {
@@ -258,8 +479,20 @@ func (s *shard) del(all *allocator, hash uint64, prev *dataNode, node *dataNode)
 }
 
 func (s *shard) newElement(all *allocator, hash uint64, key []byte, value []byte) (node *dataNode, err error) {
+	if node, err = s.allocElement(all, hash, key, uint64(len(value))); err != nil {
+		return
+	}
+	nodeTo[hashmapBucketElement](node).updateValue(value)
+	return node, nil
+}
+
+// allocElement 分配一个能放下key和valLen字节value的元素并且写入key, value由调用方写入
+func (s *shard) allocElement(all *allocator, hash uint64, key []byte, valLen uint64) (node *dataNode, err error) {
+	if hashmapElementSize(uint64(len(key)), valLen) > maxNodeSize {
+		return nil, ErrValueTooLarge
+	}
 	fs := s.freeStore(all)
-	elSize := hashmapElementSize(key, value)
+	elSize := uint32(hashmapElementSize(uint64(len(key)), valLen))
 
 	hm := s.hashmap(all)
 	if hm.len >= s.maxLen {
@@ -295,7 +528,7 @@ func (s *shard) newElement(all *allocator, hash uint64, key []byte, value []byte
 	el.reset()
 	el.hash = hash
 	el.updateKey(key)
-	el.updateValue(value)
+	el.valLen = uint32(valLen)
 	return node, nil
 }
 
@@ -0,0 +1,367 @@
+package fastcache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+	"unsafe"
+)
+
+const (
+	// snapshotMagic 快照文件头, 后面跟着2字节的版本号
+	snapshotMagic = "FCSNAP"
+	// snapshotVersion 快照格式版本, 格式和共享内存的布局无关, 只有格式本身变化时才需要修改
+	snapshotVersion uint16 = 1
+	// snapshotEntryHeaderSize count + expireAt + keyLen
+	snapshotEntryHeaderSize = 1 + 8 + 4
+	// snapshotTrailer 长度为0的记录表示结束, 后面跟着记录数量和整个记录区的crc32
+	snapshotTrailer = 0
+)
+
+// snapshotEntry 快照中的一条记录
+type snapshotEntry struct {
+	count    uint8
+	expireAt int64 // unix nano, 0表示不过期
+	key      []byte
+	value    []byte
+}
+
+// errRestoreTimeout 启动时从快照恢复超过了时间预算
+var errRestoreTimeout = errors.New("restore timeout")
+
+func (c *cache) Snapshot(w io.Writer) error {
+	if !c.enter() {
+		return ErrCacheClosed
+	}
+	defer c.exit()
+	return c.snapshot(w)
+}
+
+// snapshot 依次锁住每个分片写入快照, 只读进程不能加锁, 以seqlock的方式乐观拷贝. Close时已经不能enter, 直接调用
+func (c *cache) snapshot(w io.Writer) error {
+	sw := newSnapshotWriter(w)
+	if err := sw.writeHeader(); err != nil {
+		return err
+	}
+	var entries []snapshotEntry
+	for i := 0; i < int(c.shards.Len()); i++ {
+		shr := c.shards.shard(c.allocator, i)
+		// 持有分片锁的时候只拷贝, 写入w可能很慢, 不能阻塞这个分片
+		if c.readOnly {
+			entries = shr.optimisticSnapshot(c.allocator, entries[:0])
+		} else {
+			entries = shr.snapshot(c.allocator, entries[:0])
+		}
+		for j := range entries {
+			if err := sw.writeEntry(&entries[j]); err != nil {
+				return err
+			}
+		}
+	}
+	return sw.close()
+}
+
+func (c *cache) Restore(r io.Reader) error {
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	if !c.enter() {
+		return ErrCacheClosed
+	}
+	defer c.exit()
+	return c.restore(r, time.Time{})
+}
+
+// restore 读取快照并且写入, deadline不为0时超过deadline直接返回, 已经写入的记录保留
+func (c *cache) restore(r io.Reader, deadline time.Time) error {
+	sr := newSnapshotReader(r)
+	if err := sr.readHeader(); err != nil {
+		return err
+	}
+	now := time.Now().UnixNano()
+	for {
+		if !deadline.IsZero() && sr.count&1023 == 0 && time.Now().After(deadline) {
+			return errRestoreTimeout
+		}
+		entry, err := sr.next()
+		if err != nil {
+			return err
+		}
+		if entry == nil {
+			return nil
+		}
+		if entry.expireAt != 0 && entry.expireAt <= now {
+			continue
+		}
+		hash := xxHashBytes(entry.key)
+		if err = c.shard(hash, entry.key).restore(c.allocator, hash, entry); err != nil {
+			return err
+		}
+	}
+}
+
+// snapshot 从LRU的尾部开始拷贝分片中的所有元素, 按顺序重新写入后LRU的顺序保持不变
+func (s *shard) snapshot(all *allocator, entries []snapshotEntry) []snapshotEntry {
+	s.lock(all)
+	defer s.unlock(all)
+	base := all.base()
+	ls := s.lruStore(all)
+	for i := range ls.lruLists {
+		l := &ls.lruLists[i]
+		for ln, n := l.Back(base), uint64(0); ln != nil && n < l.len; ln, n = ln.Prev(base), n+1 {
+			el := (*hashmapBucketElement)(unsafe.Add(unsafe.Pointer(ln), -int(sizeOfHashmapBucketElement)))
+			node := (*dataNode)(unsafe.Add(unsafe.Pointer(el), -int(sizeOfDataNode)))
+			entries = append(entries, snapshotEntry{
+				count:    node.count,
+				expireAt: el.expireAt,
+				key:      append([]byte(nil), el.key()...),
+				value:    append([]byte(nil), el.value()...),
+			})
+		}
+	}
+	return entries
+}
+
+// optimisticSnapshot 只读进程拷贝分片中的所有元素. Get移动LRU时不修改seq, 遍历LRU可能读到移动了一半的链表,
+// 所以遍历hashmap, 拷贝期间分片被修改过就重新拷贝. 快照中的顺序和LRU无关, 恢复之后LRU的顺序会变
+func (s *shard) optimisticSnapshot(all *allocator, entries []snapshotEntry) []snapshotEntry {
+	start := len(entries)
+	headSize := uint64(sizeOfDataNode + sizeOfHashmapBucketElement + sizeOfLRUNode)
+	s.seqRead(all, func() {
+		entries = entries[:start]
+		hm := s.hashmap(all)
+		if !all.inBounds(hm.bucketsOffset, uint64(hm.bucketLen)*uint64(sizeOfHashmapBucket)) {
+			return
+		}
+		for i := uint64(0); i < uint64(hm.bucketLen); i++ {
+			bucket := hm.byIndex(all, i)
+			offset := bucket.linkedFirstOffset
+			// 每一个偏移量都检查在映射的内存范围内, 读到写了一半的数据也不会越界访问
+			for j := uint32(0); j < bucket.len; j++ {
+				if !all.inBounds(offset, headSize) {
+					return
+				}
+				node := toDataNode(all, offset)
+				el := nodeTo[hashmapBucketElement](node)
+				if !all.inBounds(offset, headSize+uint64(el.keyLen)+uint64(el.valLen)) {
+					return
+				}
+				entries = append(entries, snapshotEntry{
+					count:    node.count,
+					expireAt: el.expireAt,
+					key:      append([]byte(nil), el.key()...),
+					value:    el.value(),
+				})
+				offset = node.next
+			}
+		}
+	})
+	return entries
+}
+
+// restore 写入快照中的一条记录, 和Set一样记录WAL
+func (s *shard) restore(all *allocator, hash uint64, entry *snapshotEntry) error {
+	s.lock(all)
+	defer s.unlock(all)
+	s.beginWrite()
+	defer s.endWrite()
+	s.markDirty(undoSet, hash)
+	defer s.clearDirty()
+
+	node, err := s.set(all, hash, entry.key, entry.value)
+	if err != nil {
+		return err
+	}
+	node.count = entry.count
+	nodeTo[hashmapBucketElement](node).expireAt = entry.expireAt
+	return all.journalSet(entry.key, entry.value, entry.expireAt)
+}
+
+// snapshotWriter 快照格式: magic + version, 然后是若干条 [body长度 uint32][crc32 uint32][body] 记录,
+// 最后是长度为0的结束标记 + 记录数量 uint64 + 所有记录的crc32
+type snapshotWriter struct {
+	w     *bufio.Writer
+	buf   []byte
+	count uint64
+	crc   uint32
+}
+
+func newSnapshotWriter(w io.Writer) *snapshotWriter {
+	return &snapshotWriter{w: bufio.NewWriter(w)}
+}
+
+func (sw *snapshotWriter) writeHeader() error {
+	head := binary.LittleEndian.AppendUint16([]byte(snapshotMagic), snapshotVersion)
+	_, err := sw.w.Write(head)
+	return err
+}
+
+func (sw *snapshotWriter) writeEntry(entry *snapshotEntry) error {
+	b := append(sw.buf[:0], make([]byte, 8)...)
+	b = append(b, entry.count)
+	b = binary.LittleEndian.AppendUint64(b, uint64(entry.expireAt))
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(entry.key)))
+	b = append(b, entry.key...)
+	b = append(b, entry.value...)
+	body := b[8:]
+	binary.LittleEndian.PutUint32(b, uint32(len(body)))
+	binary.LittleEndian.PutUint32(b[4:], crc32.ChecksumIEEE(body))
+	sw.buf = b
+
+	sw.crc = crc32.Update(sw.crc, crc32.IEEETable, b)
+	sw.count++
+	_, err := sw.w.Write(b)
+	return err
+}
+
+func (sw *snapshotWriter) close() error {
+	b := binary.LittleEndian.AppendUint32(nil, snapshotTrailer)
+	b = binary.LittleEndian.AppendUint64(b, sw.count)
+	b = binary.LittleEndian.AppendUint32(b, sw.crc)
+	if _, err := sw.w.Write(b); err != nil {
+		return err
+	}
+	return sw.w.Flush()
+}
+
+type snapshotReader struct {
+	r     *bufio.Reader
+	head  [8]byte
+	body  []byte
+	count uint64
+	crc   uint32
+}
+
+func newSnapshotReader(r io.Reader) *snapshotReader {
+	return &snapshotReader{r: bufio.NewReader(r)}
+}
+
+func snapshotInvalid(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrSnapshotInvalid, fmt.Sprintf(format, args...))
+}
+
+func (sr *snapshotReader) readHeader() error {
+	head := make([]byte, len(snapshotMagic)+2)
+	if _, err := io.ReadFull(sr.r, head); err != nil {
+		return snapshotInvalid("read header: %v", err)
+	}
+	if string(head[:len(snapshotMagic)]) != snapshotMagic {
+		return snapshotInvalid("bad magic")
+	}
+	if version := binary.LittleEndian.Uint16(head[len(snapshotMagic):]); version != snapshotVersion {
+		return snapshotInvalid("unsupported version %d", version)
+	}
+	return nil
+}
+
+// next 读取下一条记录, 读到结束标记并且校验通过时返回nil
+func (sr *snapshotReader) next() (*snapshotEntry, error) {
+	if _, err := io.ReadFull(sr.r, sr.head[:4]); err != nil {
+		return nil, snapshotInvalid("read entry: %v", err)
+	}
+	size := binary.LittleEndian.Uint32(sr.head[:4])
+	if size == snapshotTrailer {
+		return nil, sr.readTrailer()
+	}
+	if size < snapshotEntryHeaderSize {
+		return nil, snapshotInvalid("entry size %d too small", size)
+	}
+	if _, err := io.ReadFull(sr.r, sr.head[4:]); err != nil {
+		return nil, snapshotInvalid("read entry: %v", err)
+	}
+	if cap(sr.body) < int(size) {
+		sr.body = make([]byte, size)
+	}
+	body := sr.body[:size]
+	if _, err := io.ReadFull(sr.r, body); err != nil {
+		return nil, snapshotInvalid("read entry: %v", err)
+	}
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(sr.head[4:]) {
+		return nil, snapshotInvalid("entry %d checksum mismatch", sr.count)
+	}
+	sr.crc = crc32.Update(sr.crc, crc32.IEEETable, sr.head[:])
+	sr.crc = crc32.Update(sr.crc, crc32.IEEETable, body)
+	sr.count++
+
+	keyLen := binary.LittleEndian.Uint32(body[9:])
+	if uint64(keyLen) > uint64(size-snapshotEntryHeaderSize) {
+		return nil, snapshotInvalid("entry %d key length %d overflow", sr.count, keyLen)
+	}
+	key := body[snapshotEntryHeaderSize : snapshotEntryHeaderSize+keyLen]
+	return &snapshotEntry{
+		count:    body[0],
+		expireAt: int64(binary.LittleEndian.Uint64(body[1:])),
+		key:      key,
+		value:    body[snapshotEntryHeaderSize+keyLen:],
+	}, nil
+}
+
+func (sr *snapshotReader) readTrailer() error {
+	b := make([]byte, 12)
+	if _, err := io.ReadFull(sr.r, b); err != nil {
+		return snapshotInvalid("read trailer: %v", err)
+	}
+	if count := binary.LittleEndian.Uint64(b); count != sr.count {
+		return snapshotInvalid("expect %d entries, got %d", count, sr.count)
+	}
+	if binary.LittleEndian.Uint32(b[8:]) != sr.crc {
+		return snapshotInvalid("checksum mismatch")
+	}
+	return nil
+}
+
+// saveSnapshotFile 关闭时把快照写到path, 先写临时文件再rename, 崩溃时不会留下不完整的快照
+func (c *cache) saveSnapshotFile(path string) (err error) {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+	if err = c.snapshot(f); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// loadSnapshotFile 启动时从path恢复, 最多花费budget, 快照损坏或者超时都只是少恢复一部分数据, 不影响启动.
+// complete为false表示超时只恢复了一部分, 快照文件本身是好的, 之后不能被覆盖
+func (c *cache) loadSnapshotFile(path string, budget time.Duration) (complete bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	defer f.Close()
+	err = c.restore(f, time.Now().Add(budget))
+	switch {
+	case errors.Is(err, errRestoreTimeout):
+		return false, nil
+	case errors.Is(err, ErrSnapshotInvalid):
+		// 损坏的快照没有保留的价值, 下次Close直接覆盖
+		return true, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,193 @@
+package fastcache
+
+import (
+	"errors"
+	"io"
+	"unsafe"
+)
+
+func (c *cache) SetFromReader(key []byte, r io.Reader, size int64) error {
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	if size < 0 {
+		return ErrInvalidSize
+	}
+	// 加上元素头和key之后不能超过最大的大小分类, 否则在uint32下计算元素大小会溢出
+	if _, err := hashmapElementIndex(uint64(len(key)), uint64(size)); err != nil {
+		return err
+	}
+	if !c.enter() {
+		return ErrCacheClosed
+	}
+	defer c.exit()
+	hash := xxHashBytes(key)
+	c.counters.add(hash, opSet)
+	shr := c.shard(hash, key)
+	return shr.SetFromReader(c.allocator, hash, key, r, uint64(size))
+}
+
+func (c *cache) GetReader(key []byte) (io.ReadCloser, error) {
+	if !c.enter() {
+		return nil, ErrCacheClosed
+	}
+	defer c.exit()
+	hash := xxHashBytes(key)
+	c.counters.add(hash, opGet)
+	shr := c.shard(hash, key)
+	vr := &valueReader{c: c, shr: shr, hash: hash, key: append([]byte(nil), key...)}
+	var err error
+	if c.readOnly {
+		shr.optimisticRead(c.allocator, hash, key, func(node *dataNode, el *hashmapBucketElement) {
+			if node == nil {
+				err = ErrNotFound
+				return
+			}
+			vr.version, vr.size, err = el.version, int(el.valLen), nil
+		})
+	} else {
+		vr.version, vr.size, err = shr.OpenValue(c.allocator, hash, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return vr, nil
+}
+
+// SetFromReader 在分片锁内分配新的元素, 释放锁之后把r中的size字节直接读到共享内存中, 全部读完之后重新加锁替换原来的元素.
+// 读取的时候元素还没有挂到hashmap和LRU上, 其他进程看不到, 读取失败时原来的值保持不变
+func (s *shard) SetFromReader(all *allocator, hash uint64, key []byte, r io.Reader, size uint64) error {
+	node, err := s.allocDetached(all, hash, key, size)
+	if err != nil {
+		return err
+	}
+	el := nodeTo[hashmapBucketElement](node)
+	if _, err = io.ReadFull(r, unsafe.Slice((*byte)(el.valPtr()), size)); err != nil {
+		s.lock(all)
+		s.beginWrite()
+		s.freeStore(all).free(all, node)
+		s.endWrite()
+		s.unlock(all)
+		return err
+	}
+
+	s.lock(all)
+	defer s.unlock(all)
+
+	// 读取期间可能被其他进程修改或者删除了, 重新查找原来的元素
+	prev, old := s.lookup(all, hash, key)
+	s.beginWrite()
+	defer s.endWrite()
+	s.markDirty(undoSet, hash)
+	defer s.clearDirty()
+
+	if old != nil {
+		if err = s.del(all, hash, prev, old); err != nil {
+			s.freeStore(all).free(all, node)
+			return err
+		}
+	}
+	s.hashmap(all).add(all, hash, node)
+	s.lruStore(all).pushToFront(all, node.freeIndex, el.lruNode())
+	s.stamp(el)
+	return all.journal(walSet, key, el.valueView())
+}
+
+// allocDetached 分配一个不挂到hashmap和LRU上的元素, 分配时可能淘汰其他元素, 所以也要标记修改.
+// 持有者在挂上去之前退出的话这个节点会泄漏, 不会被其他进程复用
+func (s *shard) allocDetached(all *allocator, hash uint64, key []byte, size uint64) (*dataNode, error) {
+	s.lock(all)
+	defer s.unlock(all)
+
+	s.beginWrite()
+	defer s.endWrite()
+	s.markDirty(undoSet, hash)
+	defer s.clearDirty()
+	return s.allocElement(all, hash, key, size)
+}
+
+// OpenValue 和Get一样增加计数并且移动LRU, 返回value当前的版本号和大小, 之后由ReadValue分段读取
+func (s *shard) OpenValue(all *allocator, hash uint64, key []byte) (uint64, int, error) {
+	s.lock(all)
+	defer s.unlock(all)
+
+	_, node := s.lookup(all, hash, key)
+	if node == nil {
+		return 0, 0, ErrNotFound
+	}
+	node.count++
+
+	el := nodeTo[hashmapBucketElement](node)
+	ls := s.lruStore(all)
+	s.markDirty(undoMove, hash)
+	ls.moveToFront(all, node.freeIndex, el.lruNode())
+	s.clearDirty()
+	return el.version, int(el.valLen), nil
+}
+
+// ReadValue 从value的offset处拷贝到p, value在OpenValue之后被修改过时返回ErrVersionMismatch
+func (s *shard) ReadValue(all *allocator, hash uint64, key []byte, version uint64, offset int, p []byte) (int, error) {
+	s.lock(all)
+	defer s.unlock(all)
+
+	_, node := s.lookup(all, hash, key)
+	if node == nil {
+		return 0, ErrVersionMismatch
+	}
+	el := nodeTo[hashmapBucketElement](node)
+	if el.version != version {
+		return 0, ErrVersionMismatch
+	}
+	return copy(p, el.valueView()[offset:]), nil
+}
+
+// valueReader GetReader返回的reader, 每次Read只在拷贝的时候持有分片锁, 通过版本号发现读取过程中value被修改
+type valueReader struct {
+	c       *cache
+	shr     *shard
+	hash    uint64
+	key     []byte
+	version uint64
+	size    int
+	offset  int
+	closed  bool
+}
+
+func (r *valueReader) Read(p []byte) (int, error) {
+	if r.closed {
+		return 0, errors.New("read on closed reader")
+	}
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	c := r.c
+	if !c.enter() {
+		return 0, ErrCacheClosed
+	}
+	defer c.exit()
+
+	var n int
+	var err error
+	if c.readOnly {
+		r.shr.optimisticRead(c.allocator, r.hash, r.key, func(node *dataNode, el *hashmapBucketElement) {
+			// 读到写了一半的数据时valLen可能不对, 重试之后会读到一致的数据
+			if node == nil || el.version != r.version || int(el.valLen) != r.size {
+				n, err = 0, ErrVersionMismatch
+				return
+			}
+			n, err = copy(p, el.valueView()[r.offset:]), nil
+		})
+	} else {
+		n, err = r.shr.ReadValue(c.allocator, r.hash, r.key, r.version, r.offset, p)
+	}
+	r.offset += n
+	return n, err
+}
+
+func (r *valueReader) Close() error {
+	r.closed = true
+	return nil
+}
@@ -0,0 +1,371 @@
+package fastcache
+
+import (
+	"errors"
+	"sort"
+	"unsafe"
+)
+
+// Tx is the handle passed to the callback of Transaction, it is only valid inside the callback.
+// Reads see the writes made earlier in the same transaction, writes are applied when the callback returns nil.
+type Tx struct {
+	c      *cache
+	shards []int // 持有锁的分片下标
+	writes []txWrite
+	done   bool
+}
+
+// txWrite 事务中缓存的一次写入, 回调返回nil之后按顺序写入
+type txWrite struct {
+	shr    *shard
+	hash   uint64
+	key    []byte
+	value  []byte
+	delete bool
+}
+
+func (c *cache) Transaction(keys [][]byte, fn func(tx *Tx) error) error {
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	if len(keys) == 0 {
+		return errors.New("transaction requires at least one key")
+	}
+	if !c.enter() {
+		return ErrCacheClosed
+	}
+	defer c.exit()
+
+	index := c.shardIndex(xxHashBytes(keys[0]), keys[0])
+	for _, key := range keys[1:] {
+		if c.shardIndex(xxHashBytes(key), key) != index {
+			return ErrCrossShard
+		}
+	}
+	return c.runTx([]int{index}, fn)
+}
+
+func (c *cache) MultiTransaction(keys [][]byte, fn func(tx *Tx) error) error {
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	if len(keys) == 0 {
+		return errors.New("transaction requires at least one key")
+	}
+	if !c.enter() {
+		return ErrCacheClosed
+	}
+	defer c.exit()
+
+	indexes := make([]int, 0, len(keys))
+	for _, key := range keys {
+		indexes = append(indexes, c.shardIndex(xxHashBytes(key), key))
+	}
+	sort.Ints(indexes)
+	n := 0
+	for _, index := range indexes {
+		if n == 0 || indexes[n-1] != index {
+			indexes[n] = index
+			n++
+		}
+	}
+	return c.runTx(indexes[:n], fn)
+}
+
+// runTx 按分片下标从小到大加锁, 所有进程都按同样的顺序加锁, 不会死锁. indexes需要已经排好序并且去重
+func (c *cache) runTx(indexes []int, fn func(tx *Tx) error) error {
+	for _, index := range indexes {
+		c.shards.shard(c.allocator, index).lock(c.allocator)
+	}
+	defer func() {
+		for i := len(indexes) - 1; i >= 0; i-- {
+			c.shards.shard(c.allocator, indexes[i]).unlock(c.allocator)
+		}
+	}()
+
+	tx := &Tx{c: c, shards: indexes}
+	defer func() { tx.done = true }()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+// Get returns a copy of the value of key, it returns ErrNotFound when key not exists.
+// It does not move LRU
+func (tx *Tx) Get(key []byte) ([]byte, error) {
+	shr, hash, err := tx.shard(key)
+	if err != nil {
+		return nil, err
+	}
+	tx.c.counters.add(hash, opGet)
+	// 后写入的优先
+	for i := len(tx.writes) - 1; i >= 0; i-- {
+		w := &tx.writes[i]
+		if w.hash == hash && string(w.key) == string(key) {
+			if w.delete {
+				return nil, ErrNotFound
+			}
+			return append([]byte(nil), w.value...), nil
+		}
+	}
+	_, node := shr.lookup(tx.c.allocator, hash, key)
+	if node == nil {
+		return nil, ErrNotFound
+	}
+	return nodeTo[hashmapBucketElement](node).value(), nil
+}
+
+// Set sets key to value when the transaction commits
+func (tx *Tx) Set(key []byte, value []byte) error {
+	shr, hash, err := tx.shard(key)
+	if err != nil {
+		return err
+	}
+	tx.c.counters.add(hash, opSet)
+	tx.writes = append(tx.writes, txWrite{shr: shr, hash: hash, key: append([]byte(nil), key...), value: append([]byte(nil), value...)})
+	return nil
+}
+
+// Delete deletes key when the transaction commits, deleting a key which not exists is not an error
+func (tx *Tx) Delete(key []byte) error {
+	shr, hash, err := tx.shard(key)
+	if err != nil {
+		return err
+	}
+	tx.c.counters.add(hash, opDelete)
+	tx.writes = append(tx.writes, txWrite{shr: shr, hash: hash, key: append([]byte(nil), key...), delete: true})
+	return nil
+}
+
+// shard key所在的分片, 只能访问事务已经锁住的分片
+func (tx *Tx) shard(key []byte) (*shard, uint64, error) {
+	if tx.done {
+		return nil, 0, errors.New("transaction finished")
+	}
+	hash := xxHashBytes(key)
+	index := tx.c.shardIndex(hash, key)
+	for _, i := range tx.shards {
+		if i == index {
+			return tx.c.shards.shard(tx.c.allocator, index), hash, nil
+		}
+	}
+	return nil, 0, ErrCrossShard
+}
+
+// txEvicted 预留空间时淘汰的元素, 预留失败时原样放回
+type txEvicted struct {
+	shr      *shard
+	hash     uint64
+	key      []byte
+	value    []byte
+	expireAt int64
+	version  uint64
+	count    uint8
+}
+
+// txReserved 预留给一次写入的新元素
+type txReserved struct {
+	shr  *shard
+	node *dataNode
+}
+
+// commit 写入事务中的修改, 调用方需要持有所有分片的锁. 同一个key只有最后一次写入生效.
+// 先给需要新元素的写入预留好空间, 预留失败时释放已经预留的元素并且放回为此淘汰的元素, 分片和事务开始之前完全一样.
+// 预留成功之后的写入不会再分配内存, 也就不会失败. 整个过程在每个分片的beginWrite/endWrite内,
+// 只读进程要么看到全部修改, 要么一个都看不到
+func (tx *Tx) commit() error {
+	if len(tx.writes) == 0 {
+		return nil
+	}
+	all := tx.c.allocator
+	for _, index := range tx.shards {
+		tx.c.shards.shard(all, index).beginWrite()
+	}
+	defer func() {
+		for _, index := range tx.shards {
+			tx.c.shards.shard(all, index).endWrite()
+		}
+	}()
+
+	// 只保留每个key最后一次写入, 保持最后一次出现的顺序
+	last := make(map[string]int, len(tx.writes))
+	for i := range tx.writes {
+		last[string(tx.writes[i].key)] = i
+	}
+	writes := make([]*txWrite, 0, len(last))
+	for i := range tx.writes {
+		if last[string(tx.writes[i].key)] == i {
+			writes = append(writes, &tx.writes[i])
+		}
+	}
+
+	reserved, err := tx.reserve(all, writes, last)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for i, w := range writes {
+		if err := w.shr.applyWrite(all, w, reserved[i]); err != nil {
+			// 内存中已经写入, 只有WAL出错, 继续写完剩下的
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// reserve 给需要新元素的写入预留元素, 返回和writes一一对应的节点, 不需要新元素的为nil.
+// 空间不足时和Set一样淘汰LRU尾部的元素, 但是不会淘汰事务中的key, 失败时恢复所有的修改
+func (tx *Tx) reserve(all *allocator, writes []*txWrite, keys map[string]int) ([]*dataNode, error) {
+	// 先检查大小, 不满足时不做任何修改
+	for _, w := range writes {
+		if !w.delete {
+			if _, err := hashmapElementIndex(uint64(len(w.key)), uint64(len(w.value))); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	nodes := make([]*dataNode, len(writes))
+	var order []txReserved
+	var evicted []txEvicted
+	added := make(map[*shard]uint64) // 每个分片将要新增的key数量
+	for i, w := range writes {
+		if w.delete {
+			continue
+		}
+		_, node := w.shr.hashmap(all).find(all, w.hash, w.key)
+		if node != nil {
+			if index, _ := hashmapElementIndex(uint64(len(w.key)), uint64(len(w.value))); index <= node.freeIndex {
+				// 原地覆盖
+				continue
+			}
+		} else {
+			added[w.shr]++
+		}
+		node, err := w.shr.reserveElement(all, w, added[w.shr], keys, &evicted)
+		if err != nil {
+			for j := len(order) - 1; j >= 0; j-- {
+				order[j].shr.freeStore(all).free(all, order[j].node)
+			}
+			for j := len(evicted) - 1; j >= 0; j-- {
+				evicted[j].shr.restoreEvicted(all, &evicted[j])
+			}
+			return nil, err
+		}
+		nodes[i] = node
+		order = append(order, txReserved{shr: w.shr, node: node})
+	}
+	return nodes, nil
+}
+
+// reserveElement 分配一个能放下w的元素, 不加入hashmap和LRU. added是包括这次在内将要新增的key数量,
+// 和allocElement一样超过maxLen或者空间不足时淘汰, 淘汰的元素记录到evicted
+func (s *shard) reserveElement(all *allocator, w *txWrite, added uint64, keys map[string]int, evicted *[]txEvicted) (*dataNode, error) {
+	elSize := uint32(hashmapElementSize(uint64(len(w.key)), uint64(len(w.value))))
+	if s.hashmap(all).len+added > s.maxLen {
+		if err := s.evictSaved(all, elSize, keys, evicted); err != nil && !errors.Is(err, ErrLRUListIsEmpty) {
+			return nil, err
+		}
+	}
+	node, err := s.freeStore(all).get(all, elSize)
+	if err != nil {
+		if !errors.Is(err, ErrNoSpace) {
+			return nil, err
+		}
+		if err = s.evictSaved(all, elSize, keys, evicted); err != nil {
+			return nil, err
+		}
+		if node, err = s.freeStore(all).get(all, elSize); err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
+}
+
+// evictSaved 和evict一样淘汰LRU尾部的元素, 淘汰之前拷贝一份, 尾部是事务中的key时返回ErrNoSpace
+func (s *shard) evictSaved(all *allocator, elSize uint32, keys map[string]int, evicted *[]txEvicted) error {
+	lruList := s.lruStore(all).get(sizeToIndex(elSize))
+	if lruList.len == 0 {
+		return ErrLRUListIsEmpty
+	}
+	oldest := lruList.Back(all.base())
+	el := (*hashmapBucketElement)(unsafe.Pointer(uintptr(unsafe.Pointer(oldest)) - sizeOfHashmapBucketElement))
+	if _, ok := keys[string(el.key())]; ok {
+		return ErrNoSpace
+	}
+	key := append([]byte(nil), el.key()...)
+	prev, node := s.hashmap(all).find(all, el.hash, key)
+	*evicted = append(*evicted, txEvicted{
+		shr: s, hash: el.hash, key: key, value: el.value(), expireAt: el.expireAt, version: el.version, count: node.count,
+	})
+	s.markDirty(undoDelete, el.hash)
+	defer s.clearDirty()
+	return s.del(all, el.hash, prev, node)
+}
+
+// restoreEvicted 把预留时淘汰的元素放回LRU尾部, 版本号和过期时间都不变.
+// 按淘汰的相反顺序放回, 释放预留元素之后对应大小分类的free list一定有空闲的节点
+func (s *shard) restoreEvicted(all *allocator, e *txEvicted) {
+	node, err := s.freeStore(all).get(all, uint32(hashmapElementSize(uint64(len(e.key)), uint64(len(e.value)))))
+	if err != nil {
+		return
+	}
+	s.markDirty(undoSet, e.hash)
+	defer s.clearDirty()
+	el := nodeTo[hashmapBucketElement](node)
+	el.reset()
+	el.hash = e.hash
+	el.updateKey(e.key)
+	el.updateValue(e.value)
+	el.expireAt = e.expireAt
+	el.version = e.version
+	node.count = e.count
+	s.hashmap(all).add(all, e.hash, node)
+	s.lruStore(all).get(node.freeIndex).PushBack(all.base(), el.lruNode())
+}
+
+// applyWrite 写入事务中的一次修改, 调用方需要持有分片锁并且已经beginWrite.
+// reserved不为nil时使用预留的元素, 否则key不存在或者原地覆盖, 都不会分配内存
+func (s *shard) applyWrite(all *allocator, w *txWrite, reserved *dataNode) error {
+	hm := s.hashmap(all)
+	prev, node := hm.find(all, w.hash, w.key)
+	if w.delete {
+		if node == nil {
+			return nil
+		}
+		s.markDirty(undoDelete, w.hash)
+		defer s.clearDirty()
+		if err := s.del(all, w.hash, prev, node); err != nil {
+			return err
+		}
+		return all.journal(walDelete, w.key, nil)
+	}
+
+	s.markDirty(undoSet, w.hash)
+	defer s.clearDirty()
+	ls := s.lruStore(all)
+	if reserved == nil {
+		el := nodeTo[hashmapBucketElement](node)
+		el.updateValue(w.value)
+		ls.moveToFront(all, node.freeIndex, el.lruNode())
+	} else {
+		if node != nil {
+			if err := s.del(all, w.hash, prev, node); err != nil {
+				return err
+			}
+		}
+		node = reserved
+		el := nodeTo[hashmapBucketElement](node)
+		el.reset()
+		el.hash = w.hash
+		el.updateKey(w.key)
+		el.updateValue(w.value)
+		hm.add(all, w.hash, node)
+		ls.pushToFront(all, node.freeIndex, el.lruNode())
+	}
+	el := nodeTo[hashmapBucketElement](node)
+	el.expireAt = 0
+	s.stamp(el)
+	return all.journal(walSet, w.key, w.value)
+}
@@ -0,0 +1,273 @@
+package fastcache
+
+import (
+	"fmt"
+	"sync/atomic"
+	"unsafe"
+)
+
+// maxShardProblems 每个分片最多记录的问题数量
+const maxShardProblems = 32
+
+// VerifyReport result of Cache.Verify
+type VerifyReport struct {
+	// Shards number of shards checked
+	Shards int
+	// Corrupted shards which break at least one invariant
+	Corrupted []ShardReport
+}
+
+// ShardReport problems found in one shard
+type ShardReport struct {
+	Index    int
+	Problems []string
+	// Repaired is true when the shard has been reset
+	Repaired bool
+}
+
+// shardChecker 检查一个分片的hashmap链表, LRU链表和free链表是否一致
+type shardChecker struct {
+	all      *allocator
+	limit    uint64 // 所有偏移量必须小于metadata.Used
+	live     map[uint64]struct{}
+	problems []string
+}
+
+func newShardChecker(all *allocator) *shardChecker {
+	limit := all.metadata.Used
+	if size := all.mem.Size(); limit > size {
+		limit = size
+	}
+	return &shardChecker{all: all, limit: limit, live: make(map[uint64]struct{})}
+}
+
+func (c *shardChecker) addf(format string, args ...any) {
+	if len(c.problems) < maxShardProblems {
+		c.problems = append(c.problems, fmt.Sprintf(format, args...))
+	}
+}
+
+// nodeInRange dataNode开始的size字节是否都在已经分配的内存范围内
+func (c *shardChecker) nodeInRange(offset uint64, size uint64) bool {
+	end := offset + size
+	return offset >= uint64(sizeOfMetadata) && end >= offset && end <= c.limit
+}
+
+// verify 检查分片的所有不变量, 调用方需要持有分片锁, 返回发现的问题
+func (s *shard) verify(all *allocator) []string {
+	c := newShardChecker(all)
+	if !c.nodeInRange(s.hashmapOffset, uint64(sizeOfHashmap)) ||
+		!c.nodeInRange(s.lruStoreOffset, uint64(sizeOfLRUStore)) ||
+		!c.nodeInRange(s.freeStoreOffset, uint64(sizeOfFreeStore)) {
+		c.addf("shard structures out of range")
+		return c.problems
+	}
+	c.checkHashmap(s.hashmap(all))
+	c.checkLRU(s.lruStore(all), s.hashmap(all).len)
+	c.checkFreeStore(s.freeStore(all))
+	return c.problems
+}
+
+func (c *shardChecker) checkHashmap(hm *hashmap) {
+	bucketsSize := uint64(hm.bucketLen) * uint64(sizeOfHashmapBucket)
+	if hm.bucketLen == 0 || !c.nodeInRange(hm.bucketsOffset, bucketsSize) {
+		c.addf("hashmap buckets out of range: offset %d, len %d", hm.bucketsOffset, hm.bucketLen)
+		return
+	}
+	headSize := uint64(sizeOfDataNode + sizeOfHashmapBucketElement + sizeOfLRUNode)
+	total := uint64(0)
+	for i := uint64(0); i < uint64(hm.bucketLen); i++ {
+		bucket := hm.byIndex(c.all, i)
+		offset := bucket.linkedFirstOffset
+		for j := uint32(0); j < bucket.len; j++ {
+			if !c.nodeInRange(offset, headSize) {
+				c.addf("bucket %d: node offset %d out of range", i, offset)
+				break
+			}
+			if _, ok := c.live[offset]; ok {
+				c.addf("bucket %d: node offset %d linked twice", i, offset)
+				break
+			}
+			node := toDataNode(c.all, offset)
+			el := nodeTo[hashmapBucketElement](node)
+			if int(node.freeIndex) >= len(freeStore{}.freeLists) {
+				c.addf("bucket %d: node offset %d invalid free index %d", i, offset, node.freeIndex)
+				break
+			}
+			elSize := uint64(sizeOfHashmapBucketElement+sizeOfLRUNode) + uint64(el.keyLen) + uint64(el.valLen)
+			if elSize > 1<<node.freeIndex || !c.nodeInRange(offset, uint64(sizeOfDataNode)+elSize) {
+				c.addf("bucket %d: node offset %d element size %d overflow", i, offset, elSize)
+				break
+			}
+			c.live[offset] = struct{}{}
+			if hash := xxHashBytes(el.key()); hash != el.hash {
+				c.addf("bucket %d: node offset %d hash %#x mismatch key hash %#x", i, offset, el.hash, hash)
+			} else if el.hash%uint64(hm.bucketLen) != i {
+				c.addf("bucket %d: node offset %d hash %#x in wrong bucket", i, offset, el.hash)
+			}
+			offset = node.next
+		}
+		total += uint64(bucket.len)
+	}
+	if total != hm.len {
+		c.addf("hashmap len %d mismatch buckets total %d", hm.len, total)
+	}
+}
+
+func (c *shardChecker) checkLRU(ls *lruStore, hashmapLen uint64) {
+	base := c.all.base()
+	total := uint64(0)
+	for i := range ls.lruLists {
+		l := &ls.lruLists[i]
+		root := l.root.Offset(base)
+		prev := root
+		offset := l.root.next
+		count := uint64(0)
+		for offset != root {
+			if count >= l.len {
+				c.addf("lru %d: more nodes than len %d", i, l.len)
+				break
+			}
+			if !c.nodeInRange(offset, uint64(sizeOfLRUNode)) {
+				c.addf("lru %d: node offset %d out of range", i, offset)
+				break
+			}
+			ln := (*listNode)(unsafe.Add(c.all.mem.Ptr(), offset))
+			if ln.prev != prev {
+				c.addf("lru %d: node offset %d prev %d, expect %d", i, offset, ln.prev, prev)
+				break
+			}
+			nodeOffset := offset - uint64(sizeOfHashmapBucketElement+sizeOfDataNode)
+			if _, ok := c.live[nodeOffset]; !ok {
+				c.addf("lru %d: node offset %d not in hashmap", i, nodeOffset)
+			} else if node := toDataNode(c.all, nodeOffset); int(node.freeIndex) != i {
+				c.addf("lru %d: node offset %d free index %d", i, nodeOffset, node.freeIndex)
+			}
+			count++
+			prev = offset
+			offset = ln.next
+		}
+		if offset == root && (count != l.len || l.root.prev != prev) {
+			c.addf("lru %d: len %d mismatch nodes %d", i, l.len, count)
+		}
+		total += l.len
+	}
+	if total != hashmapLen {
+		c.addf("lru total len %d mismatch hashmap len %d", total, hashmapLen)
+	}
+}
+
+func (c *shardChecker) checkFreeStore(fs *freeStore) {
+	seen := make(map[uint64]struct{})
+	for i := range fs.freeLists {
+		c.checkFreeList(i, &fs.freeLists[i], seen)
+	}
+}
+
+// checkFreeList 检查一个free链表, 有问题返回false
+func (c *shardChecker) checkFreeList(i int, fl *freeList, seen map[uint64]struct{}) bool {
+	if int(fl.index) != i || fl.size != 1<<i {
+		c.addf("free list %d: invalid index %d size %d", i, fl.index, fl.size)
+		return false
+	}
+	offset := fl.firstDataNodeOffset
+	for j := uint32(0); j < fl.len; j++ {
+		if !c.nodeInRange(offset, uint64(sizeOfDataNode)+uint64(fl.size)) {
+			c.addf("free list %d: node offset %d out of range", i, offset)
+			return false
+		}
+		if _, ok := c.live[offset]; ok {
+			c.addf("free list %d: node offset %d is also in hashmap", i, offset)
+			return false
+		}
+		if _, ok := seen[offset]; ok {
+			c.addf("free list %d: node offset %d linked twice", i, offset)
+			return false
+		}
+		seen[offset] = struct{}{}
+		node := toDataNode(c.all, offset)
+		if int(node.freeIndex) != i {
+			c.addf("free list %d: node offset %d free index %d", i, offset, node.freeIndex)
+			return false
+		}
+		offset = node.next
+	}
+	return true
+}
+
+// reset 把分片重置为空, 调用方需要持有分片锁. 原来存储数据的内存没有办法可靠回收会被丢弃,
+// free链表只要检查通过就保留
+func (s *shard) reset(all *allocator) {
+	hm := s.hashmap(all)
+	for i := uint64(0); i < uint64(hm.bucketLen); i++ {
+		hm.byIndex(all, i).reset()
+	}
+	hm.len = 0
+	s.lruStore(all).init(all)
+
+	fs := s.freeStore(all)
+	c := newShardChecker(all)
+	seen := make(map[uint64]struct{})
+	for i := range fs.freeLists {
+		fl := &fs.freeLists[i]
+		if !c.checkFreeList(i, fl, seen) {
+			fl.reset()
+			fl.index = uint8(i)
+			fl.size = 1 << i
+		}
+	}
+}
+
+func (c *cache) Verify(repair bool) (*VerifyReport, error) {
+	if repair && c.readOnly {
+		return nil, ErrReadOnly
+	}
+	if !c.enter() {
+		return nil, ErrCacheClosed
+	}
+	defer c.exit()
+
+	report := &VerifyReport{Shards: int(c.shards.Len())}
+	for i := 0; i < int(c.shards.Len()); i++ {
+		shr := c.shards.shard(c.allocator, i)
+		problems, repaired := shr.verifyAndRepair(c.allocator, repair, !c.readOnly)
+		if len(problems) > 0 {
+			report.Corrupted = append(report.Corrupted, ShardReport{Index: i, Problems: problems, Repaired: repaired})
+		}
+	}
+	return report, nil
+}
+
+func (s *shard) verifyAndRepair(all *allocator, repair bool, lock bool) ([]string, bool) {
+	var problems []string
+	if lock {
+		locker := s.locker(all)
+		locker.lock(all)
+		defer locker.Unlock()
+		all.remap()
+		problems = s.verify(all)
+	} else {
+		// 只读进程不能加锁, 和optimisticRead一样检查期间分片被修改过就重新检查, 不会把正在进行的修改当成损坏
+		s.seqRead(all, func() {
+			problems = s.verify(all)
+		})
+	}
+	// 持有锁的情况下seq还是奇数或者undo记录还在, 说明有进程在修改过程中退出
+	if lock && (atomic.LoadUint64(&s.seq)&1 == 1 || atomic.LoadUint32(&s.undo.op) != undoNone) {
+		problems = append(problems, fmt.Sprintf("write interrupted by a dead process, undo op %d", s.undo.op))
+	}
+	if len(problems) == 0 || !repair {
+		return problems, false
+	}
+	if meta := all.metadata; meta.hasFlag(metaFlagDurable) {
+		meta.Checkpoint.markDirty()
+	}
+	if atomic.LoadUint64(&s.seq)&1 == 1 {
+		atomic.AddUint64(&s.seq, 1)
+	}
+	s.beginWrite()
+	s.reset(all)
+	s.clearDirty()
+	s.endWrite()
+	return problems, true
+}
@@ -0,0 +1,313 @@
+package fastcache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// walSuffix MMAP文件对应的WAL文件后缀
+	walSuffix = ".wal"
+	// walMagic WAL文件头
+	walMagic = "FCWAL001"
+	// walHeaderSize magic + checkpoint generation
+	walHeaderSize = len(walMagic) + 8
+	// walRecordHeaderSize crc32 + body长度
+	walRecordHeaderSize = 8
+)
+
+// WAL中记录的操作
+const (
+	walSet uint8 = iota + 1
+	walDelete
+	walSetExpire // value前面是8字节的过期时间
+)
+
+var walBufPool = sync.Pool{New: func() any { return new([]byte) }}
+
+// wal 进程内打开的WAL文件, 所有进程以O_APPEND的方式追加写同一个文件, 每条记录一次write保证不会交错.
+// 记录在持有分片锁的时候写入, 同一个key的记录顺序和修改顺序一致.
+// checkpoint通过rename替换WAL文件之后会更新metadata中的generation, 其他进程下一次追加时发现不一致就重新打开
+type wal struct {
+	path       string
+	meta       *metadata
+	f          atomic.Pointer[os.File]
+	generation uint64     // 打开文件时metadata中的checkpoint generation
+	mu         sync.Mutex // 重新打开文件
+	policy     WALSyncPolicy
+	period     time.Duration
+	dirty      uint32 // 有还没有fsync的记录
+}
+
+// openWAL 打开或者创建WAL文件, 新文件写入当前checkpoint的generation作为文件头
+func openWAL(path string, all *allocator, config *Config) (w *wal, err error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+		}
+	}()
+	w = &wal{path: path, meta: all.metadata, policy: config.WALSync, period: config.WALSyncPeriod}
+	w.f.Store(f)
+
+	// 和checkpoint压缩WAL互斥
+	all.locker.Lock()
+	defer all.locker.Unlock()
+	w.generation = atomic.LoadUint64(&all.metadata.Checkpoint.Generation)
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == 0 {
+		head := binary.LittleEndian.AppendUint64([]byte(walMagic), w.generation)
+		if _, err = f.Write(head); err != nil {
+			return nil, err
+		}
+		if err = f.Sync(); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// reopen WAL文件已经被checkpoint替换, 重新打开
+func (w *wal) reopen(generation uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if atomic.LoadUint64(&w.generation) == generation {
+		return nil
+	}
+	f, err := os.OpenFile(w.path, os.O_RDWR|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	// 替换之前的记录都写完了: checkpoint替换文件时持有所有的分片锁
+	old := w.f.Swap(f)
+	atomic.StoreUint64(&w.generation, generation)
+	return old.Close()
+}
+
+// append 追加一条记录, 调用方需要持有分片锁
+func (w *wal) append(op uint8, key []byte, value []byte) error {
+	bp := walBufPool.Get().(*[]byte)
+	defer walBufPool.Put(bp)
+	b := append((*bp)[:0], make([]byte, walRecordHeaderSize)...)
+	b = append(b, op)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(key)))
+	b = append(b, key...)
+	b = append(b, value...)
+	body := b[walRecordHeaderSize:]
+	binary.LittleEndian.PutUint32(b, crc32.ChecksumIEEE(body))
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(body)))
+	*bp = b
+
+	if gen := atomic.LoadUint64(&w.meta.Checkpoint.Generation); gen != atomic.LoadUint64(&w.generation) {
+		if err := w.reopen(gen); err != nil {
+			return err
+		}
+	}
+	f := w.f.Load()
+	if _, err := f.Write(b); err != nil {
+		return err
+	}
+	switch w.policy {
+	case WALSyncAlways:
+		return f.Sync()
+	case WALSyncInterval:
+		atomic.StoreUint32(&w.dirty, 1)
+	}
+	return nil
+}
+
+// sync 把还没有fsync的记录刷到磁盘
+func (w *wal) sync() error {
+	if atomic.CompareAndSwapUint32(&w.dirty, 1, 0) {
+		return w.f.Load().Sync()
+	}
+	return nil
+}
+
+// size 当前WAL文件的大小, 调用方需要持有所有的分片锁, 否则其他进程可能正在追加
+func (w *wal) size() (int64, error) {
+	info, err := w.f.Load().Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// rewrite checkpoint成功之后压缩WAL, keep之前的记录都已经包含在checkpoint中, 只保留之后追加的记录.
+// 先写临时文件再rename, 崩溃时要么是完整的旧文件要么是完整的新文件. 调用方需要持有所有的分片锁,
+// 并且已经把metadata中的generation更新为generation
+func (w *wal) rewrite(generation uint64, keep int64) (err error) {
+	size, err := w.size()
+	if err != nil {
+		return err
+	}
+	b := binary.LittleEndian.AppendUint64([]byte(walMagic), generation)
+	b = append(b, make([]byte, size-keep)...)
+	if _, err = w.f.Load().ReadAt(b[walHeaderSize:], keep); err != nil {
+		return err
+	}
+
+	tmp := w.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+	if _, err = f.Write(b); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, w.path); err != nil {
+		return err
+	}
+	if err = syncDir(filepath.Dir(w.path)); err != nil {
+		return err
+	}
+	atomic.StoreUint32(&w.dirty, 0)
+	return w.reopen(generation)
+}
+
+func (w *wal) close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return errors.Join(w.sync(), w.f.Load().Close())
+}
+
+func (c *cache) walSyncLoop(w *wal) {
+	defer c.wg.Done()
+	ticker := time.NewTicker(w.period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			_ = w.sync()
+		}
+	}
+}
+
+// replayWAL 在checkpoint的基础上重放WAL, 只有WAL的generation和checkpoint一致时才有效.
+// 末尾不完整或者checksum不对的记录是崩溃时没有写完的, 重放后截断, 否则之后追加的记录再也读不到
+func (c *cache) replayWAL(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	head := make([]byte, walHeaderSize)
+	if _, err = io.ReadFull(r, head); err != nil {
+		// 文件头都没有写完, 由openWAL重新写入
+		return f.Truncate(0)
+	}
+	if string(head[:len(walMagic)]) != walMagic {
+		return fmt.Errorf("%w: bad wal file magic", ErrCheckpointInvalid)
+	}
+	// checkpoint在释放锁之后才写文件和压缩WAL, 中途崩溃时WAL和metadata的generation可能差一代.
+	// 这时WAL中的记录要么已经包含在内存里, 要么是之后的修改, 记录的都是完整的值, 重复重放不影响结果
+	if gen, cur := binary.LittleEndian.Uint64(head[len(walMagic):]), c.allocator.metadata.Checkpoint.Generation; gen != cur && gen+1 != cur && gen != cur+1 {
+		// 很久之前的WAL, 记录都已经包含在checkpoint中
+		return c.compactStaleWAL(f)
+	}
+
+	valid := int64(walHeaderSize)
+	for {
+		n, err := c.replayRecord(r)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		valid += n
+	}
+	if info, err := f.Stat(); err != nil || info.Size() == valid {
+		return err
+	}
+	return f.Truncate(valid)
+}
+
+// compactStaleWAL 重写一个generation和checkpoint一致的空WAL
+func (c *cache) compactStaleWAL(f *os.File) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	head := binary.LittleEndian.AppendUint64([]byte(walMagic), c.allocator.metadata.Checkpoint.Generation)
+	if _, err := f.WriteAt(head, 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// replayRecord 重放一条记录, 返回记录的长度, 0表示没有更多完整的记录
+func (c *cache) replayRecord(r *bufio.Reader) (int64, error) {
+	recordHead := make([]byte, walRecordHeaderSize)
+	if _, err := io.ReadFull(r, recordHead); err != nil {
+		return 0, nil
+	}
+	checksum := binary.LittleEndian.Uint32(recordHead)
+	size := binary.LittleEndian.Uint32(recordHead[4:])
+	if size < 5 || uint64(size) > c.allocator.metadata.TotalSize {
+		return 0, nil
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil || crc32.ChecksumIEEE(body) != checksum {
+		return 0, nil
+	}
+	op := body[0]
+	keyLen := binary.LittleEndian.Uint32(body[1:])
+	if uint64(keyLen) > uint64(size-5) {
+		return 0, nil
+	}
+	key := body[5 : 5+keyLen]
+	hash := xxHashBytes(key)
+	shr := c.shard(hash, key)
+	var err error
+	switch op {
+	case walSet:
+		err = shr.Set(c.allocator, hash, key, body[5+keyLen:])
+	case walDelete:
+		if err = shr.Delete(c.allocator, hash, key); errors.Is(err, ErrNotFound) {
+			err = nil
+		}
+	case walSetExpire:
+		value := body[5+keyLen:]
+		if len(value) < 8 {
+			return 0, nil
+		}
+		err = shr.SetWithExpire(c.allocator, hash, key, value[8:], int64(binary.LittleEndian.Uint64(value)))
+	default:
+		return 0, nil
+	}
+	return int64(walRecordHeaderSize) + int64(size), err
+}